@@ -13,8 +13,23 @@ do
       r) atlas_private_key=${OPTARG};;
   esac
 done
-echo "${atlas_pub_key}"
-echo "${atlas_private_key}"
+
+# the keys never come from the command line, where they would show in ps and in the build logs:
+# -r and -k only take references (gcpsm://, env://, file://), without them the keys are read from
+# MONGO_UTIL_ATLAS_PRIVATE_KEY and MONGO_UTIL_DATA_API_KEY (eg: a Jenkins credentials binding)
+case "${atlas_private_key}" in
+  gcpsm://*|env://*|file://*) ;;
+  "") if [ -n "${MONGO_UTIL_ATLAS_PRIVATE_KEY}" ]; then atlas_private_key="env://MONGO_UTIL_ATLAS_PRIVATE_KEY"; fi;;
+  *) echo "-r takes a reference (gcpsm://, env://, file://), set the key in MONGO_UTIL_ATLAS_PRIVATE_KEY instead"
+     exit 1;;
+esac
+case "${data_api_key}" in
+  gcpsm://*|env://*|file://*) ;;
+  "") if [ -n "${MONGO_UTIL_DATA_API_KEY}" ]; then data_api_key="env://MONGO_UTIL_DATA_API_KEY"; fi;;
+  *) echo "-k takes a reference (gcpsm://, env://, file://), set the key in MONGO_UTIL_DATA_API_KEY instead"
+     exit 1;;
+esac
+
 os=linux
 arch=amd64
 
@@ -35,7 +50,7 @@ then
     fi
 fi
 
-
+go mod vendor
 env GOOS=${os} GOARCH=${arch} go build -o mongo_util_${os}_${arch}
 if [ $? -ne 0 ];
 then
@@ -45,7 +60,6 @@ fi
 echo "Build is successful."
 
 pwd
-#atlas_private_key="561002ad-65b1-4ac3-90fd-600a46218a39"
 ./mongo_util_${os}_${arch} -command="${command}" -project_name="${project_name}" -db="${db}" -cluster="${cluster}" -collection="${collection}" -data_api_key="${data_api_key}"  -atlas_pub_key="${atlas_pub_key}" -atlas_private_key="${atlas_private_key}"
 
 if [ $? -ne 0 ];
@@ -1,5 +1,4 @@
 #!/bin/sh
-set -x
 while getopts x:p:d:c:t:k:b:r:q: option
 do
   case "${option}" in
@@ -15,6 +14,22 @@ do
   esac
 done
 
+# the keys never come from the command line, where they would show in ps and in the build logs:
+# -r and -k only take references (gcpsm://, env://, file://), without them the keys are read from
+# MONGO_UTIL_ATLAS_PRIVATE_KEY and MONGO_UTIL_DATA_API_KEY (eg: a Jenkins credentials binding)
+case "${atlas_private_key}" in
+  gcpsm://*|env://*|file://*) ;;
+  "") if [ -n "${MONGO_UTIL_ATLAS_PRIVATE_KEY}" ]; then atlas_private_key="env://MONGO_UTIL_ATLAS_PRIVATE_KEY"; fi;;
+  *) echo "-r takes a reference (gcpsm://, env://, file://), set the key in MONGO_UTIL_ATLAS_PRIVATE_KEY instead"
+     exit 1;;
+esac
+case "${data_api_key}" in
+  gcpsm://*|env://*|file://*) ;;
+  "") if [ -n "${MONGO_UTIL_DATA_API_KEY}" ]; then data_api_key="env://MONGO_UTIL_DATA_API_KEY"; fi;;
+  *) echo "-k takes a reference (gcpsm://, env://, file://), set the key in MONGO_UTIL_DATA_API_KEY instead"
+     exit 1;;
+esac
+
 os=darwin
 arch=amd64
 
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	mongo "mongo-util/mongo"
+	secrets "mongo-util/secrets"
+	"time"
+)
+
+const (
+	//apiKeyVerifyAttempts leaves the new API key time to be usable across Atlas
+	apiKeyVerifyAttempts = 5
+	apiKeyVerifyInterval = 5 * time.Second
+)
+
+//apiKeySecret is the payload saved in secret manager for an API key
+type apiKeySecret struct {
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+}
+
+//apiKeySecretID is the secret the API key pair is saved to, gcp.api_key_secret_id or <OrgID>-atlas-api-key
+func apiKeySecretID(orgID string) string {
+	if config.GCP.APIKeySecretID != "" {
+		return config.GCP.APIKeySecretID
+	}
+	return orgID + "-atlas-api-key"
+}
+
+//rotateAPIKeys replaces the Atlas API key in use (-atlas_pub_key) by a new key with the same roles and
+//access list. The new pair is saved in the secret store of the project and verified before the old key is deleted.
+func rotateAPIKeys(projectName *string, dryRun bool) error {
+	if projectName == nil || *projectName == "" {
+		return fmt.Errorf("%s argument is required to find the organization of the API key", ProjectName)
+	}
+	config.Mongo.ProjectName = *projectName
+	project, err := mongo.GetProjectByProjectName(config.Mongo)
+	if err != nil {
+		return err
+	}
+
+	keys, err := mongo.GetAPIKeys(project.OrgID, config.Mongo)
+	if err != nil {
+		return fmt.Errorf("list API keys of the organization %s: %v", project.OrgID, err)
+	}
+	var oldKey *configuration.APIKey
+	for i := range keys {
+		if keys[i].PublicKey == config.Mongo.PublicKey {
+			oldKey = &keys[i]
+		}
+	}
+	if oldKey == nil {
+		return fmt.Errorf("API key %s is not an API key of the organization %s", config.Mongo.PublicKey, project.OrgID)
+	}
+	accessList, err := mongo.GetAPIKeyAccessList(project.OrgID, oldKey.ID, config.Mongo)
+	if err != nil {
+		return fmt.Errorf("get access list of the API key %s: %v", oldKey.PublicKey, err)
+	}
+
+	//organization roles are granted at creation, project roles are granted per project afterwards
+	var orgRoles []string
+	projectRoles := make(map[string][]string)
+	for _, role := range oldKey.Roles {
+		if role.GroupID != "" {
+			projectRoles[role.GroupID] = append(projectRoles[role.GroupID], role.RoleName)
+			continue
+		}
+		orgRoles = append(orgRoles, role.RoleName)
+	}
+	secretID := apiKeySecretID(project.OrgID)
+
+	//the store is checked before a key is created, a new key which can't be saved would be lost
+	ctx := context.Background()
+	store, err := openStore(ctx, storeType())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	saver, ok := store.(secrets.IDSaver)
+	if !ok {
+		return fmt.Errorf("secret store %s can't save the API key, rotate_api_keys needs a gcp secret store", storeType())
+	}
+
+	if dryRun {
+		log.Printf("DRY RUN: would create an API key %q with the organization roles %v and the project roles %v",
+			oldKey.Desc, orgRoles, projectRoles)
+		log.Printf("DRY RUN: would copy %d access list entries, save the key to secret %s and delete the API key %s",
+			len(accessList), secretID, oldKey.PublicKey)
+		return nil
+	}
+
+	newKey, err := mongo.CreateAPIKey(project.OrgID, oldKey.Desc, orgRoles, config.Mongo)
+	if err != nil {
+		return fmt.Errorf("create API key: %v", err)
+	}
+	log.Printf("created API key %s", newKey.PublicKey)
+
+	if len(accessList) > 0 {
+		if err := mongo.AddAPIKeyAccessList(project.OrgID, newKey.ID, accessList, config.Mongo); err != nil {
+			return discardAPIKey(project.OrgID, newKey, fmt.Errorf("copy access list: %v", err))
+		}
+	}
+	for groupID, roles := range projectRoles {
+		if err := mongo.AssignAPIKeyToProject(groupID, newKey.ID, roles, config.Mongo); err != nil {
+			return discardAPIKey(project.OrgID, newKey, fmt.Errorf("grant roles on project %s: %v", groupID, err))
+		}
+	}
+
+	payload, err := json.Marshal(apiKeySecret{PublicKey: newKey.PublicKey, PrivateKey: newKey.PrivateKey})
+	if err != nil {
+		return discardAPIKey(project.OrgID, newKey, err)
+	}
+	version, err := saver.SaveSecretByID(ctx, secretID, string(payload))
+	if err != nil {
+		return discardAPIKey(project.OrgID, newKey, fmt.Errorf("save API key to secret %s: %v", secretID, err))
+	}
+	log.Printf("API key %s saved to %s", newKey.PublicKey, version)
+
+	newConfig := config.Mongo
+	newConfig.PublicKey, newConfig.PrivateKey = newKey.PublicKey, newKey.PrivateKey
+	if err := verifyAPIKey(newConfig); err != nil {
+		if dErr := store.DestroyVersion(ctx, version); dErr != nil {
+			log.Printf("RECOVERY NEEDED: destroy the secret version %s of the unusable API key %s: %v", version, newKey.PublicKey, dErr)
+		}
+		return discardAPIKey(project.OrgID, newKey, fmt.Errorf("verify new API key: %v", err))
+	}
+
+	//the old key is deleted with the new one, which proves the new key can manage the organization keys
+	if err := mongo.DeleteAPIKey(project.OrgID, oldKey.ID, newConfig); err != nil {
+		log.Printf("RECOVERY NEEDED: the new API key %s is in use, delete the old API key %s manually", newKey.PublicKey, oldKey.PublicKey)
+		return fmt.Errorf("delete old API key: %v", err)
+	}
+	log.Printf("API key %s is replaced by %s", oldKey.PublicKey, newKey.PublicKey)
+	return nil
+}
+
+//verifyAPIKey checks the new key can read the project, retrying while Atlas propagates it
+func verifyAPIKey(config configuration.Mongo) error {
+	var err error
+	for attempt := 1; attempt <= apiKeyVerifyAttempts; attempt++ {
+		if _, err = mongo.GetProjectByProjectName(config); err == nil {
+			return nil
+		}
+		if attempt < apiKeyVerifyAttempts {
+			log.Printf("new API key can't read the project yet (attempt %d/%d): %v", attempt, apiKeyVerifyAttempts, err)
+			time.Sleep(apiKeyVerifyInterval)
+		}
+	}
+	return err
+}
+
+//discardAPIKey deletes a new API key after a failed rotation, the old key is left untouched
+func discardAPIKey(orgID string, key *configuration.APIKey, cause error) error {
+	if err := mongo.DeleteAPIKey(orgID, key.ID, config.Mongo); err != nil {
+		log.Printf("RECOVERY NEEDED: delete the unused API key %s manually: %v", key.PublicKey, err)
+	}
+	return errors.New("API key rotation failed, the old key is still in use: " + cause.Error())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	"os"
+	"sync"
+	"time"
+)
+
+//CheckpointFile records the progress of update_passwords user by user, so that an interrupted run can be resumed
+const CheckpointFile = "rotation_checkpoint.jsonl"
+
+//CheckpointStarted is recorded before a user is rotated, the outcome of the rotation is recorded after it.
+//A user left started was interrupted, its password may or may not have been changed.
+const CheckpointStarted = "started"
+
+//checkpointRecord is a line of CheckpointFile
+type checkpointRecord struct {
+	Time      string `json:"time"`
+	ProjectID string `json:"project_id"`
+	Username  string `json:"username"`
+	DBName    string `json:"database"`
+	State     string `json:"state"`
+}
+
+//checkpoint appends the progress of a run to CheckpointFile and knows the users rotated by the interrupted run
+type checkpoint struct {
+	mu   sync.Mutex
+	file *os.File
+	//rotated are the users whose last record in the interrupted run is OutcomeRotated
+	rotated map[string]bool
+}
+
+func checkpointKey(projectID, dbName, username string) string {
+	return projectID + "/" + dbName + "/" + username
+}
+
+//openCheckpoint starts a new CheckpointFile, or with resume reads the one of the interrupted run and appends to it.
+//With dryRun the file is only read.
+func openCheckpoint(resume, dryRun bool) (*checkpoint, error) {
+	c := &checkpoint{rotated: make(map[string]bool)}
+	if resume {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return c, nil
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(CheckpointFile, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open checkpoint file: %v", err)
+	}
+	c.file = file
+	return c, nil
+}
+
+//load reads the last state of every user from CheckpointFile
+func (c *checkpoint) load() error {
+	file, err := os.Open(CheckpointFile)
+	if os.IsNotExist(err) {
+		log.Printf("WARNING: no %s to resume from, every selected user is rotated", CheckpointFile)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read checkpoint file: %v", err)
+	}
+	defer file.Close()
+
+	started := 0
+	last := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record checkpointRecord
+		//the last line may be cut if the run died while writing it
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		last[checkpointKey(record.ProjectID, record.DBName, record.Username)] = record.State
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read checkpoint file: %v", err)
+	}
+	for key, state := range last {
+		switch state {
+		case OutcomeRotated:
+			c.rotated[key] = true
+		case CheckpointStarted:
+			started++
+		}
+	}
+	log.Printf("resuming: %d users were rotated by the interrupted run, %d were interrupted and are retried", len(c.rotated), started)
+	return nil
+}
+
+//done tells if the interrupted run rotated the user
+func (c *checkpoint) done(user configuration.MongoUser) bool {
+	return c.rotated[checkpointKey(user.ProjectID, user.DBName, user.Username)]
+}
+
+//record appends the state of a user, the file is synced so that it survives the job being killed
+func (c *checkpoint) record(user configuration.MongoUser, state string) {
+	if c.file == nil {
+		return
+	}
+	line, err := json.Marshal(checkpointRecord{
+		Time:      time.Now().Format(time.RFC3339),
+		ProjectID: user.ProjectID,
+		Username:  user.Username,
+		DBName:    user.DBName,
+		State:     state,
+	})
+	if err != nil {
+		log.Println("checkpoint error:", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err == nil {
+		err = c.file.Sync()
+	}
+	if err != nil {
+		log.Println("checkpoint error:", err)
+	}
+}
+
+//Close closes CheckpointFile
+func (c *checkpoint) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
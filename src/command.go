@@ -1,33 +1,129 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	configuration "mongo-util/config"
-	gcp "mongo-util/gcp"
 	mongo "mongo-util/mongo"
+	secrets "mongo-util/secrets"
+	"strings"
+	"sync"
 )
 
-func updatePasswords(projectName *string) error {
-	if projectName == nil {
-		return errors.New("project_name argument is missing the value")
+//updatePasswords rotates the users of the projects named in projectNames (comma separated),
+//or of all the projects of the organization orgID. Projects are rotated in turn, a failing project
+//doesn't stop the others and every project is reported on its own in the summary.
+func updatePasswords(projectNames, orgID *string, opts rotationOptions) error {
+	if (projectNames == nil || *projectNames == "") && (orgID == nil || *orgID == "") {
+		return fmt.Errorf("%s or %s argument is missing the value", ProjectName, OrgID)
 	}
-	config.Mongo.ProjectName = *projectName
-	//Get projectId for a given project name through Atlas API
-	project, err := mongo.GetProjectByProjectName(config.Mongo)
-	if err != nil {
-		log.Fatalln("GetProjectByProjectName error :", err)
+	if err := config.PasswordPolicy.Validate(); err != nil {
 		return err
 	}
-	config.Mongo.ProjectID = project.ID
-	err = updateMongoUsers()
+	if err := validReportFormat(opts.ReportFormat); err != nil {
+		return err
+	}
+	if _, err := opts.maxAge(); err != nil {
+		return err
+	}
+	if err := secrets.ValidateSecretNameTemplate(config); err != nil {
+		return err
+	}
+	if err := config.GCP.Retention.Validate(); err != nil {
+		return err
+	}
+	if err := validSecretFormat(); err != nil {
+		return err
+	}
+	if err := validKubernetes(); err != nil {
+		return err
+	}
+	if err := validStoreRoutes(); err != nil {
+		return err
+	}
+	if err := config.GCP.ValidateSecretSettings(); err != nil {
+		return err
+	}
+
+	var projects []configuration.Project
+	if orgID != nil && *orgID != "" {
+		var err error
+		if projects, err = mongo.GetProjectsByOrg(*orgID, config.Mongo); err != nil {
+			return fmt.Errorf("list projects of the organization %s: %v", *orgID, err)
+		}
+		log.Printf("Total projects under %s : %d", *orgID, len(projects))
+	}
+	if projectNames != nil && *projectNames != "" {
+		for _, name := range strings.Split(*projectNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				projects = append(projects, configuration.Project{Name: name})
+			}
+		}
+	}
+
+	cp, err := openCheckpoint(opts.Resume, opts.DryRun)
 	if err != nil {
 		return err
 	}
+	defer cp.Close()
+
+	var summaries []projectSummary
+	for _, project := range projects {
+		summary := updateProjectPasswords(project, opts, cp)
+		if summary.Error != "" {
+			log.Printf("project %s failed: %s", summary.Name, summary.Error)
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := generateRotationSummary(summaries); err != nil {
+		log.Println("rotation summary error:", err)
+	}
+
+	if opts.DryRun {
+		log.Println("dry run completed, nothing has been changed")
+		return nil
+	}
+	for _, summary := range summaries {
+		if summary.Error != "" || summary.Failed > 0 {
+			return errors.New("some projects or users could not be rotated, check the rotation summary")
+		}
+	}
 	log.Println("passwords update successful")
-	return err
+	return nil
+}
+
+//updateProjectPasswords rotates the users of a project, a project listed by name only is resolved first
+func updateProjectPasswords(project configuration.Project, opts rotationOptions, cp *checkpoint) projectSummary {
+	summary := projectSummary{Name: project.Name, ID: project.ID}
+	log.Printf("rotating the project %s", project.Name)
+
+	config.Mongo.ProjectName = project.Name
+	config.Mongo.ProjectID = project.ID
+	filter, err := rotationFilter(project.Name, opts.Filter)
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+	if project.ID == "" {
+		//Get projectId for a given project name through Atlas API
+		resolved, err := mongo.GetProjectByProjectName(config.Mongo)
+		if err != nil {
+			summary.Error = fmt.Sprintf("GetProjectByProjectName error: %v", err)
+			return summary
+		}
+		config.Mongo.ProjectID = resolved.ID
+		summary.ID = resolved.ID
+	}
+
+	results, err := updateMongoUsers(filter, opts, cp)
+	summary.count(results)
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
 }
 
 func generateClusterDetailReport(projectName *string) error {
@@ -90,33 +186,197 @@ var dbColumns = []string{"Name", "GroupId", "ClusterType", "DiskSizeGB", "NumSha
 
 var gridfsColumns = []string{"Database", "Collection", "ContentType", "FileCount", "TotalSize"}
 
-func updateMongoUsers() error {
+//updateMongoUsers rotates the users of the project in config.Mongo and returns the outcome of every user
+func updateMongoUsers(filter *userFilter, opts rotationOptions, cp *checkpoint) ([]rotationResult, error) {
 	//Fetch the list of mongodb users
 	users, err := mongo.GetUsersByProject(config.Mongo)
 	if err != nil {
-		log.Fatalln("get users:", err)
-		return err
+		return nil, fmt.Errorf("get users: %v", err)
 	}
 	log.Printf("Total users under %s : %d", config.Mongo.ProjectID, len(users))
 
+	//the users rotated by the interrupted run are not rotated again, the interrupted ones are retried
+	var results []rotationResult
+	var pending []configuration.MongoUser
 	for _, userInfo := range users {
+		if cp.done(userInfo) {
+			log.Printf("skipping %s of the DB %s: rotated by the interrupted run", userInfo.Username, userInfo.DBName)
+			results = append(results, skipped(userInfo, "rotated by the interrupted run"))
+			continue
+		}
+		pending = append(pending, userInfo)
+	}
+	users = pending
+
+	//only the users which will be rotated need a secret of their own, a user which can't get one fails alone
+	var selected []configuration.MongoUser
+	for _, userInfo := range users {
+		if skipReason(userInfo, filter, opts.IssueX509Certs) == "" {
+			selected = append(selected, userInfo)
+		}
+	}
+	nameErrors := checkSecretNames(selected)
+
+	maxAge, err := opts.maxAge()
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun && maxAge == 0 {
+		planPasswordUpdates(nil, users, filter, opts, nameErrors)
+		return nil, nil
+	}
+
+	//A single secret store client is shared by all the workers
+	ctx := context.Background()
+	store, err := openSecretStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	if opts.DryRun {
+		//secret ages are read to plan an age based rotation, nothing is written
+		planPasswordUpdates(store, users, filter, opts, nameErrors)
+		return nil, nil
+	}
 
-		//Length 16 is expected
-		pwd := configuration.RandomString(16)
-		//log.Printf("Updating user %s with new password %s", result.Username, pwd)
-		if err := mongo.UpdatePassword(pwd, userInfo, config.Mongo); err != nil {
-			log.Printf("unable to change %s password for the DB: %s", userInfo.Username, userInfo.DBName)
-			//log.Println(err)
+	kubeClient, err := openKubernetes()
+	if err != nil {
+		return nil, err
+	}
+	rotator := &rotator{store: store, maxAge: maxAge, verify: config.Rotation.Verify, issueCerts: opts.IssueX509Certs, kube: kubeClient}
+	verify := opts.Verify || config.Rotation.Verify.Enabled
+	if verify || jsonSecrets() {
+		clusters, err := projectClusters()
+		if err != nil {
+			return nil, err
+		}
+		rotator.connections = clusters
+		if verify {
+			rotator.clusters = clusters
+		}
+	}
+
+	workers := opts.workers()
+	log.Printf("rotating with %d workers", workers)
+	jobs := make(chan configuration.MongoUser)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for userInfo := range jobs {
+				cp.record(userInfo, CheckpointStarted)
+				result := rotator.rotateUser(ctx, userInfo)
+				cp.record(userInfo, result.Outcome)
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, userInfo := range users {
+		if reason := skipReason(userInfo, filter, opts.IssueX509Certs); reason != "" {
+			log.Printf("skipping %s of the DB %s: %s", userInfo.Username, userInfo.DBName, reason)
+			mu.Lock()
+			results = append(results, skipped(userInfo, reason))
+			mu.Unlock()
 			continue
 		}
+		if err := nameErrors[checkpointKey(userInfo.ProjectID, userInfo.DBName, userInfo.Username)]; err != nil {
+			log.Printf("unable to rotate %s of the DB %s: %v", userInfo.Username, userInfo.DBName, err)
+			mu.Lock()
+			results = append(results, failed(userInfo, "", err))
+			mu.Unlock()
+			continue
+		}
+		jobs <- userInfo
+	}
+	close(jobs)
+	wg.Wait()
 
-		//Save to GCP secret manager
-		if err := gcp.SaveSecret(config, userInfo, pwd); err != nil {
-			log.Printf("gcp error: while updating the user %s for the DB %s :", userInfo.Username, userInfo.DBName)
-			return err
+	if err := generateRotationReport(config.Mongo.ProjectName, results, opts.ReportFormat); err != nil {
+		log.Println("rotation report error:", err)
+		return results, err
+	}
+	return results, nil
+}
+
+//planPasswordUpdates logs what updateMongoUsers would do, neither Atlas nor secret manager is touched.
+//With maxAge set the secret ages are read through store. nameErrors are the users checkSecretNames refused.
+func planPasswordUpdates(store secrets.Store, users []configuration.MongoUser, filter *userFilter, opts rotationOptions, nameErrors map[string]error) {
+	ctx := context.Background()
+	maxAge, _ := opts.maxAge()
+	rotate, skip := 0, 0
+	for _, userInfo := range users {
+		if reason := skipReason(userInfo, filter, opts.IssueX509Certs); reason != "" {
+			log.Printf("DRY RUN: would skip %s of the DB %s: %s", userInfo.Username, userInfo.DBName, reason)
+			skip++
+			continue
 		}
+		if err := nameErrors[checkpointKey(userInfo.ProjectID, userInfo.DBName, userInfo.Username)]; err != nil {
+			log.Printf("DRY RUN: would fail %s of the DB %s: %v", userInfo.Username, userInfo.DBName, err)
+			continue
+		}
+		age := ""
+		if maxAge > 0 {
+			current, found, err := secretAge(ctx, store, userInfo)
+			if err != nil {
+				log.Printf("DRY RUN: would fail %s of the DB %s: unable to read the secret age: %v", userInfo.Username, userInfo.DBName, err)
+				continue
+			}
+			age = fmt.Sprintf(", secret age %s", formatAge(current, found))
+			if found && current < maxAge {
+				log.Printf("DRY RUN: would skip %s of the DB %s: secret is younger than %s%s",
+					userInfo.Username, userInfo.DBName, formatAge(maxAge, true), age)
+				skip++
+				continue
+			}
+		}
+		name, err := secretName(userInfo)
+		if err != nil {
+			log.Printf("DRY RUN: would fail %s of the DB %s: %v", userInfo.Username, userInfo.DBName, err)
+			continue
+		}
+		if userInfo.IsAtlasManagedX509() {
+			log.Printf("DRY RUN: would issue an X.509 certificate for %s of the DB %s: POST %s, save to secret %s%s",
+				userInfo.Username, userInfo.DBName, mongo.CertificateURL(userInfo, config.Mongo), name, age)
+			rotate++
+			continue
+		}
+		log.Printf("DRY RUN: would rotate %s of the DB %s: PATCH %s, save to secret %s%s",
+			userInfo.Username, userInfo.DBName, mongo.UserURL(userInfo, config.Mongo), name, age)
+		rotate++
 	}
-	return err
+	log.Printf("DRY RUN: %d users would be rotated, %d users would be skipped", rotate, skip)
+}
+
+//skipReason tells why the password of a user must not be rotated, empty if it can be rotated.
+//Atlas-managed X.509 users are rotated by issuing a new certificate when issueCerts is set.
+func skipReason(user configuration.MongoUser, filter *userFilter, issueCerts bool) string {
+	if user.Username == "" {
+		return "username is empty"
+	}
+	if !user.HasPassword() && !(issueCerts && user.IsAtlasManagedX509()) {
+		if user.IsAtlasManagedX509() {
+			return fmt.Sprintf("%s user has no password, use -%s to issue a new certificate", user.AuthType(), IssueX509Certs)
+		}
+		return fmt.Sprintf("%s user has no password", user.AuthType())
+	}
+	//temporary users are handed over to engineers, rotating them would lock them out
+	if user.IsTemporary() {
+		return "temporary user issued by issue_credentials"
+	}
+	//$external users authenticate outside of Atlas (X.509, LDAP, AWS IAM) and have no password
+	if user.HasPassword() && user.DBName == "$external" {
+		return "user authenticates externally and has no password"
+	}
+	if name := filter.excludedBy(user); name != "" {
+		return fmt.Sprintf("not selected by the %s filter", name)
+	}
+	return ""
 }
 
 func executeQuery(query *string) error {
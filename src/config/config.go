@@ -5,7 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	digest "github.com/mongodb-forks/digest"
+	"strconv"
+	"strings"
 	"time"
 
 	"net/http"
@@ -15,9 +18,13 @@ import (
 var ClusterColumns = []string{"Name", "GroupId", "ClusterType", "DiskSizeGB", "NumShards", "ReplicationFactor", "CreatedDate", "BackupEnabled", "mongoDBMajorVersion", "mongoDBVersion"}
 
 type Config struct {
-	Mongo    Mongo `json:"mongo,omitempty"`
-	GCP      GCP   `json:"gcp,omitempty"`
-	Interval int64 `json:"interval,omitempty"`
+	Mongo          Mongo          `json:"mongo,omitempty"`
+	GCP            GCP            `json:"gcp,omitempty"`
+	SecretStore    SecretStore    `json:"secret_store,omitempty"`
+	Kubernetes     Kubernetes     `json:"kubernetes,omitempty"`
+	Rotation       Rotation       `json:"rotation,omitempty"`
+	PasswordPolicy PasswordPolicy `json:"password_policy,omitempty"`
+	Interval       int64          `json:"interval,omitempty"`
 }
 
 type Mongo struct {
@@ -35,24 +42,285 @@ type GCP struct {
 	ProjectID string `json:"project_id,omitempty"`
 	// Prefix		string `json:"prefix,omitempty"`
 	ConfigPath string `json:"config_path,omitempty"`
+	//APIKeySecretID is the secret rotate_api_keys saves the Atlas API key to, <OrgID>-atlas-api-key if not set
+	APIKeySecretID string `json:"api_key_secret_id,omitempty"`
+	//SecretNameTemplate renders the secret id of a db user from .ProjectID, .ProjectName, .DBName and .Username,
+	//{{.ProjectID}}-{{.Username}} if not set
+	SecretNameTemplate string `json:"secret_name_template,omitempty"`
+	//Env is set as the env label of the secrets
+	Env string `json:"env,omitempty"`
+	//Labels are added to the labels of every secret
+	Labels map[string]string `json:"labels,omitempty"`
+	//Retention of the secret versions, applied after every rotation and by prune_secrets
+	Retention Retention `json:"retention,omitempty"`
+	//SecretFormat is what a db user secret holds: password (default) for the bare password,
+	//json for the username, password, auth database, project and connection strings of the user
+	SecretFormat string `json:"secret_format,omitempty"`
+	//Replication of the created secrets, automatic with Google-managed keys if not set
+	Replication Replication `json:"replication,omitempty"`
+	//TTL deletes a secret which isn't rotated for that long eg: 180d, every rotation pushes it back
+	TTL string `json:"ttl,omitempty"`
+	//Topics are the Pub/Sub topics notified of the changes of the secrets, projects/<project>/topics/<topic>
+	Topics []string `json:"topics,omitempty"`
+	//RotationPeriod sends a SECRET_ROTATE message to Topics that often eg: 30d
+	RotationPeriod string `json:"rotation_period,omitempty"`
+}
+
+//Replication places the secrets in the given locations only, each one with its own customer-managed key
+type Replication struct {
+	//Replicas are the user-managed locations, automatic replication if empty
+	Replicas []Replica `json:"replicas,omitempty"`
+	//KMSKeyName encrypts the automatically replicated secrets, projects/<p>/locations/global/keyRings/<r>/cryptoKeys/<k>
+	KMSKeyName string `json:"kms_key_name,omitempty"`
+}
+
+//Replica is a location of a secret, KMSKeyName must be a key of that location
+type Replica struct {
+	Location   string `json:"location"`
+	KMSKeyName string `json:"kms_key_name,omitempty"`
+}
+
+//ValidateSecretSettings checks the replication, ttl, topics and rotation_period of gcp
+func (g GCP) ValidateSecretSettings() error {
+	if len(g.Replication.Replicas) > 0 && g.Replication.KMSKeyName != "" {
+		return fmt.Errorf("invalid gcp.replication, kms_key_name is set per replica with user-managed replicas")
+	}
+	locations := map[string]bool{}
+	for _, replica := range g.Replication.Replicas {
+		if replica.Location == "" || locations[replica.Location] {
+			return fmt.Errorf("invalid gcp.replication, every replica needs a location of its own")
+		}
+		locations[replica.Location] = true
+	}
+	for name, value := range map[string]string{"ttl": g.TTL, "rotation_period": g.RotationPeriod} {
+		if value == "" {
+			continue
+		}
+		if age, err := ParseAge(value); err != nil || age < time.Hour {
+			return fmt.Errorf("invalid gcp.%s %q, expected a duration of 1h or more eg: 30d", name, value)
+		}
+	}
+	if g.RotationPeriod != "" && len(g.Topics) == 0 {
+		return fmt.Errorf("gcp.rotation_period needs gcp.topics to be notified")
+	}
+	return nil
+}
+
+//Retention keeps the KeepVersions newest enabled versions of a secret and disables the older ones,
+//versions older than DestroyAfterDays are destroyed. Zero disables either rule.
+//The newest enabled version, the current password, is never touched.
+type Retention struct {
+	KeepVersions     int `json:"keep_versions,omitempty"`
+	DestroyAfterDays int `json:"destroy_after_days,omitempty"`
+}
+
+//Enabled tells if any retention rule is set
+func (r Retention) Enabled() bool {
+	return r.KeepVersions > 0 || r.DestroyAfterDays > 0
+}
+
+//Validate rejects negative retention values
+func (r Retention) Validate() error {
+	if r.KeepVersions < 0 || r.DestroyAfterDays < 0 {
+		return fmt.Errorf("invalid gcp.retention, keep_versions and destroy_after_days can't be negative")
+	}
+	return nil
+}
+
+//Rotation settings of update_passwords, Projects overrides the defaults per Atlas project name
+type Rotation struct {
+	Workers  int                        `json:"workers,omitempty"`
+	Verify   Verify                     `json:"verify,omitempty"`
+	Filter   UserFilter                 `json:"filter,omitempty"`
+	Projects map[string]ProjectRotation `json:"projects,omitempty"`
+	//CertificateMonths is the validity of the X.509 certificates issued by Atlas, 3 if not set
+	CertificateMonths int `json:"certificate_months,omitempty"`
+}
+
+//Verify settings of the check of the new passwords against the clusters, Interval is in seconds
+type Verify struct {
+	Enabled  bool  `json:"enabled,omitempty"`
+	Attempts int   `json:"attempts,omitempty"`
+	Interval int64 `json:"interval,omitempty"`
+}
+
+type ProjectRotation struct {
+	Filter UserFilter `json:"filter,omitempty"`
+	//SecretStore is the secret_store.type of the project, the settings of the store are the ones of secret_store
+	SecretStore string `json:"secret_store,omitempty"`
+}
+
+//UserFilter holds the regular expressions selecting the users to rotate, empty ones match everything
+type UserFilter struct {
+	IncludeUsers     string `json:"include_users,omitempty"`
+	ExcludeUsers     string `json:"exclude_users,omitempty"`
+	IncludeDatabases string `json:"include_dbs,omitempty"`
+	ExcludeDatabases string `json:"exclude_dbs,omitempty"`
+	IncludeRoles     string `json:"include_roles,omitempty"`
+	ExcludeRoles     string `json:"exclude_roles,omitempty"`
+	IncludeScopes    string `json:"include_scopes,omitempty"`
+	ExcludeScopes    string `json:"exclude_scopes,omitempty"`
+}
+
+//Merge returns the filter with the non empty patterns of other taking precedence
+func (f UserFilter) Merge(other UserFilter) UserFilter {
+	pick := func(value, override string) string {
+		if override != "" {
+			return override
+		}
+		return value
+	}
+	return UserFilter{
+		IncludeUsers:     pick(f.IncludeUsers, other.IncludeUsers),
+		ExcludeUsers:     pick(f.ExcludeUsers, other.ExcludeUsers),
+		IncludeDatabases: pick(f.IncludeDatabases, other.IncludeDatabases),
+		ExcludeDatabases: pick(f.ExcludeDatabases, other.ExcludeDatabases),
+		IncludeRoles:     pick(f.IncludeRoles, other.IncludeRoles),
+		ExcludeRoles:     pick(f.ExcludeRoles, other.ExcludeRoles),
+		IncludeScopes:    pick(f.IncludeScopes, other.IncludeScopes),
+		ExcludeScopes:    pick(f.ExcludeScopes, other.ExcludeScopes),
+	}
 }
 
 type UserData struct {
-	Users []MongoUser `json:"results,omitempty"`
+	Users      []MongoUser `json:"results,omitempty"`
+	TotalCount int         `json:"totalCount,omitempty"`
 }
 
 type MongoUser struct {
-	Username    string `json:"username,omitempty"`
-	DBName      string `json:"databaseName,omitempty"`
-	ProjectID   string `json:"groupId"`
-	ProjectName string `json:"groupName"`
+	Username    string      `json:"username,omitempty"`
+	DBName      string      `json:"databaseName,omitempty"`
+	ProjectID   string      `json:"groupId"`
+	ProjectName string      `json:"groupName"`
+	Roles       []UserRole  `json:"roles,omitempty"`
+	Scopes      []UserScope `json:"scopes,omitempty"`
+	//Authentication types, NONE or empty unless the user authenticates without a password
+	X509Type     string `json:"x509Type,omitempty"`
+	AWSIAMType   string `json:"awsIAMType,omitempty"`
+	LDAPAuthType string `json:"ldapAuthType,omitempty"`
+	OIDCAuthType string `json:"oidcAuthType,omitempty"`
+	//DeleteAfterDate is set on the users Atlas deletes on their own, ISO 8601
+	DeleteAfterDate string      `json:"deleteAfterDate,omitempty"`
+	Labels          []UserLabel `json:"labels,omitempty"`
+}
+
+type UserLabel struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+//TemporaryLabel marks the db users created by issue_credentials
+var TemporaryLabel = UserLabel{Key: "mongo-util", Value: "temporary"}
+
+//IsTemporary tells whether the user was issued by issue_credentials
+func (u MongoUser) IsTemporary() bool {
+	for _, label := range u.Labels {
+		if label == TemporaryLabel {
+			return true
+		}
+	}
+	return false
+}
+
+//Authentication types of the db users
+const (
+	AuthSCRAM  = "SCRAM"
+	AuthX509   = "X509"
+	AuthAWSIAM = "AWS_IAM"
+	AuthLDAP   = "LDAP"
+	AuthOIDC   = "OIDC"
+	//X509Managed is the x509Type of the users whose certificates are issued by Atlas
+	X509Managed = "MANAGED"
+)
+
+func isSet(authType string) bool {
+	return authType != "" && authType != "NONE"
+}
+
+//AuthType tells how the user authenticates, only AuthSCRAM users have a password
+func (u MongoUser) AuthType() string {
+	switch {
+	case isSet(u.X509Type):
+		return AuthX509
+	case isSet(u.AWSIAMType):
+		return AuthAWSIAM
+	case isSet(u.LDAPAuthType):
+		return AuthLDAP
+	case isSet(u.OIDCAuthType):
+		return AuthOIDC
+	}
+	return AuthSCRAM
+}
+
+//HasPassword tells whether the password of the user can be rotated
+func (u MongoUser) HasPassword() bool {
+	return u.AuthType() == AuthSCRAM
+}
+
+//IsAtlasManagedX509 tells whether Atlas can issue certificates for the user
+func (u MongoUser) IsAtlasManagedX509() bool {
+	return u.X509Type == X509Managed
+}
+
+//UserRole is a role granted to a db user, CollectionName is empty for database wide roles
+type UserRole struct {
+	RoleName       string `json:"roleName"`
+	DatabaseName   string `json:"databaseName"`
+	CollectionName string `json:"collectionName,omitempty"`
+}
+
+//String formats the role as roleName@databaseName, the way role filters are matched
+func (r UserRole) String() string {
+	return r.RoleName + "@" + r.DatabaseName
+}
+
+//UserScope limits a db user to a cluster or a data lake, a user without scopes can access all of them
+type UserScope struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
 }
 
 type Project struct {
 	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
 	OrgID string `json:"orgId,omitempty"`
 }
 
+type ProjectData struct {
+	Projects   []Project `json:"results,omitempty"`
+	TotalCount int       `json:"totalCount,omitempty"`
+}
+
+//APIKey is an Atlas programmatic API key, PrivateKey is only returned in full when the key is created
+type APIKey struct {
+	ID         string       `json:"id,omitempty"`
+	Desc       string       `json:"desc,omitempty"`
+	PublicKey  string       `json:"publicKey,omitempty"`
+	PrivateKey string       `json:"privateKey,omitempty"`
+	Roles      []APIKeyRole `json:"roles,omitempty"`
+}
+
+//APIKeyRole is an organization role if OrgID is set, a project role if GroupID is set
+type APIKeyRole struct {
+	RoleName string `json:"roleName"`
+	OrgID    string `json:"orgId,omitempty"`
+	GroupID  string `json:"groupId,omitempty"`
+}
+
+type APIKeys struct {
+	Keys []APIKey `json:"results,omitempty"`
+}
+
+//AccessListEntry is an IP address or CIDR block an API key can be used from
+type AccessListEntry struct {
+	IPAddress string `json:"ipAddress,omitempty"`
+	CIDRBlock string `json:"cidrBlock,omitempty"`
+}
+
+type AccessList struct {
+	Entries []AccessListEntry `json:"results,omitempty"`
+}
+
 //LoadConfig from json file
 func LoadConfig(path string, config *Config) (*Config, error) {
 
@@ -68,14 +336,27 @@ func LoadConfig(path string, config *Config) (*Config, error) {
 }
 
 //HttpCall is a Generic HTTP client util method
+//Rate limited calls (429, or 503 with Retry-After) are retried after a backoff shared by all callers
 func HttpCall(method, uri string, payload []byte, config Mongo) (*http.Response, error) {
 
 	transport := digest.NewTransport(config.PublicKey, config.PrivateKey)
-	req, err := http.NewRequest(method, uri, bytes.NewReader(payload))
-	req.Header.Set("Content-Type", "application/json")
-	//req.Header.Set("api-key", "JawR9f98MUaVbCEdvDlgavs3yIjIdT4YOfz7roaJVVsjZc7pTcGz9xCYn4eRCjSj")
-	res, err := transport.RoundTrip(req)
-	return res, err
+	for attempt := 0; ; attempt++ {
+		atlasThrottle.wait()
+		req, err := http.NewRequest(method, uri, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		//req.Header.Set("api-key", "JawR9f98MUaVbCEdvDlgavs3yIjIdT4YOfz7roaJVVsjZc7pTcGz9xCYn4eRCjSj")
+		res, err := transport.RoundTrip(req)
+		if err != nil || !isRateLimited(res) || attempt >= MaxRateLimitRetries {
+			return res, err
+		}
+		d := retryAfter(res, attempt)
+		res.Body.Close()
+		logBackoff(method, uri, d, attempt)
+		atlasThrottle.backoff(d)
+	}
 }
 
 //RandomString generates Random string, base64 encoding
@@ -86,6 +367,18 @@ func RandomString(length int) string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
+//ParseAge parses a duration which, on top of the time.ParseDuration units, accepts days eg: 30d
+func ParseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(age, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q: %v", age, err)
+		}
+		return time.Duration(days * 24 * float64(time.Hour)), nil
+	}
+	return time.ParseDuration(age)
+}
+
 func TimeNow() string {
 	return time.Now().Format(time.RFC822)
 }
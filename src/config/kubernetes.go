@@ -0,0 +1,36 @@
+package config
+
+//Kubernetes copies the credentials of the rotated users to Kubernetes Secrets once they are saved in the secret store.
+//The in-cluster service account is used when running in a pod without Kubeconfig nor KUBECONFIG.
+type Kubernetes struct {
+	Enabled bool `json:"enabled,omitempty"`
+	//Kubeconfig is the kubeconfig file, KUBECONFIG or ~/.kube/config if not set
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	//Context is the current-context of the kubeconfig if not set
+	Context string `json:"context,omitempty"`
+	//Namespace is the one of the context, of the pod or default if not set
+	Namespace string `json:"namespace,omitempty"`
+	//SecretPrefix names the Secret of a user <SecretPrefix><secret id>, in lower case with _ replaced by -
+	SecretPrefix string `json:"secret_prefix,omitempty"`
+	//Apps give the users of an application a Secret of their own, the users matching no app get a Secret per user
+	//unless AppsOnly is set
+	Apps     []KubernetesApp `json:"apps,omitempty"`
+	AppsOnly bool            `json:"apps_only,omitempty"`
+	//Labels are added to the labels of every Secret
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+//KubernetesApp maps a db user to the Secret an application reads
+type KubernetesApp struct {
+	//Secret is the name of the Secret
+	Secret string `json:"secret"`
+	//Namespace is kubernetes.namespace if not set
+	Namespace string `json:"namespace,omitempty"`
+	//Project is any project if not set
+	Project  string `json:"project,omitempty"`
+	Username string `json:"username"`
+	//Database is any auth database if not set
+	Database string `json:"database,omitempty"`
+	//Deployments are restarted once the Secret is updated so that their pods read the new credentials
+	Deployments []string `json:"deployments,omitempty"`
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+//Character classes which can be required by a PasswordPolicy
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+const (
+	//DefaultPasswordLength carries the same randomness as RandomString(16)
+	DefaultPasswordLength = 22
+	//DefaultAlphabet is the base64url alphabet RandomString encodes with
+	DefaultAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	//maxGenerateAttempts bounds the retries of Generate when required classes are missing
+	maxGenerateAttempts = 100
+)
+
+//PasswordPolicy describes the generated db user passwords, zero values fall back to the defaults
+type PasswordPolicy struct {
+	Length          int      `json:"length,omitempty"`
+	Alphabet        string   `json:"alphabet,omitempty"`
+	RequiredClasses []string `json:"required_classes,omitempty"`
+	ExcludeChars    string   `json:"exclude_chars,omitempty"`
+}
+
+//length of the passwords, DefaultPasswordLength if not configured
+func (p PasswordPolicy) length() int {
+	if p.Length == 0 {
+		return DefaultPasswordLength
+	}
+	return p.Length
+}
+
+//alphabet is the configured alphabet without the excluded characters
+func (p PasswordPolicy) alphabet() []rune {
+	alphabet := p.Alphabet
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+	var runes []rune
+	seen := make(map[rune]bool)
+	for _, r := range alphabet {
+		if seen[r] || strings.ContainsRune(p.ExcludeChars, r) {
+			continue
+		}
+		seen[r] = true
+		runes = append(runes, r)
+	}
+	return runes
+}
+
+func classOf(r rune) string {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return ClassLower
+	case r >= 'A' && r <= 'Z':
+		return ClassUpper
+	case r >= '0' && r <= '9':
+		return ClassDigit
+	default:
+		return ClassSymbol
+	}
+}
+
+//Validate checks that passwords satisfying the policy can be generated
+func (p PasswordPolicy) Validate() error {
+	if p.Length < 0 {
+		return fmt.Errorf("password policy: invalid length %d", p.Length)
+	}
+	alphabet := p.alphabet()
+	if len(alphabet) < 2 {
+		return errors.New("password policy: alphabet needs at least 2 characters after exclusions")
+	}
+	if len(p.RequiredClasses) > p.length() {
+		return fmt.Errorf("password policy: length %d is shorter than the %d required classes", p.length(), len(p.RequiredClasses))
+	}
+	available := make(map[string]bool)
+	for _, r := range alphabet {
+		available[classOf(r)] = true
+	}
+	for _, class := range p.RequiredClasses {
+		switch class {
+		case ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+		default:
+			return fmt.Errorf("password policy: unknown class %q, allowed: %s, %s, %s, %s", class, ClassLower, ClassUpper, ClassDigit, ClassSymbol)
+		}
+		if !available[class] {
+			return fmt.Errorf("password policy: alphabet has no %s character", class)
+		}
+	}
+	return nil
+}
+
+//Check verifies a password against the policy
+func (p PasswordPolicy) Check(pwd string) error {
+	if n := len([]rune(pwd)); n < p.length() {
+		return fmt.Errorf("password policy: password has %d characters, %d required", n, p.length())
+	}
+	allowed := make(map[rune]bool)
+	for _, r := range p.alphabet() {
+		allowed[r] = true
+	}
+	present := make(map[string]bool)
+	for _, r := range pwd {
+		if !allowed[r] {
+			return errors.New("password policy: password has a character outside of the alphabet")
+		}
+		present[classOf(r)] = true
+	}
+	for _, class := range p.RequiredClasses {
+		if !present[class] {
+			return fmt.Errorf("password policy: password has no %s character", class)
+		}
+	}
+	return nil
+}
+
+//Generate returns a random password satisfying the policy, crypto/rand is used for every character
+func (p PasswordPolicy) Generate() (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+	alphabet := p.alphabet()
+	max := big.NewInt(int64(len(alphabet)))
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		pwd := make([]rune, p.length())
+		for i := range pwd {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			pwd[i] = alphabet[n.Int64()]
+		}
+		//passwords missing a required class are discarded rather than patched, to keep them uniform
+		if p.Check(string(pwd)) == nil {
+			return string(pwd), nil
+		}
+	}
+	return "", errors.New("password policy: unable to generate a password with the required classes")
+}
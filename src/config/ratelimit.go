@@ -0,0 +1,73 @@
+package config
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//MaxRateLimitRetries is how many times a rate limited Atlas call is retried before giving up
+	MaxRateLimitRetries = 6
+	//initialBackoff is the wait of the first retry when Atlas doesn't send Retry-After, it doubles on each retry
+	initialBackoff = 2 * time.Second
+	maxBackoff     = time.Minute
+)
+
+//atlasThrottle is shared by all the goroutines calling Atlas, once a call is rate limited
+//every caller waits until the backoff is over instead of hammering the API
+var atlasThrottle throttle
+
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+//wait blocks until the current backoff, if any, is over
+func (t *throttle) wait() {
+	t.mu.Lock()
+	until := t.until
+	t.mu.Unlock()
+	if d := time.Until(until); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+//backoff pushes the shared backoff to at least d from now
+func (t *throttle) backoff(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+}
+
+//isRateLimited tells whether Atlas refused a call because of the rate limit
+func isRateLimited(res *http.Response) bool {
+	return res.StatusCode == http.StatusTooManyRequests ||
+		(res.StatusCode == http.StatusServiceUnavailable && res.Header.Get("Retry-After") != "")
+}
+
+//retryAfter reads the Retry-After header, seconds or HTTP date, and falls back to an exponential backoff
+func retryAfter(res *http.Response, attempt int) time.Duration {
+	if value := res.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return time.Until(date)
+		}
+	}
+	d := initialBackoff << uint(attempt)
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+//logBackoff reports a rate limited call
+func logBackoff(method, uri string, d time.Duration, attempt int) {
+	log.Printf("Atlas rate limit hit on %s %s, backing off %s (retry %d/%d)", method, uri, d.Round(time.Second), attempt+1, MaxRateLimitRetries)
+}
@@ -0,0 +1,112 @@
+package config
+
+import "fmt"
+
+//Secret store types of secret_store.type
+const (
+	StoreGCP   = "gcp"
+	StoreVault = "vault"
+	StoreAWS   = "aws"
+	StoreAzure = "azure"
+	StoreFile  = "file"
+)
+
+//ValidStoreType checks a secret store type
+func ValidStoreType(storeType string) error {
+	switch storeType {
+	case StoreGCP, StoreVault, StoreAWS, StoreAzure, StoreFile:
+		return nil
+	}
+	return fmt.Errorf("unknown secret store type %q", storeType)
+}
+
+//SecretStore selects where the credentials of the db users are saved, GCP secret manager if Type is not set
+type SecretStore struct {
+	Type  string `json:"type,omitempty"`
+	Vault Vault  `json:"vault,omitempty"`
+	AWS   AWS    `json:"aws,omitempty"`
+	Azure Azure  `json:"azure,omitempty"`
+	File  File   `json:"file,omitempty"`
+	//Routes send the secrets of the matching users to several stores at once, the first matching route applies
+	//and the users matching none use the store of Type
+	Routes []StoreRoute `json:"routes,omitempty"`
+}
+
+//StoreRoute names the stores the secrets of some users are saved to, empty fields match every user
+type StoreRoute struct {
+	Project string `json:"project,omitempty"`
+	//Users and Databases are regular expressions on the username and the auth database
+	Users     string `json:"users,omitempty"`
+	Databases string `json:"databases,omitempty"`
+	//Stores are secret store types, a write succeeds only if all of them accept it. The first one is read back.
+	Stores []string `json:"stores"`
+}
+
+//Vault is a HashiCorp Vault KV v2 secrets engine, the secret of a user is saved under <Mount>/data/<PathPrefix>/<secret id>.
+//It authenticates with AppRole if RoleID is set, with Token otherwise.
+type Vault struct {
+	//Address is the Vault server eg: https://vault.example.com:8200, VAULT_ADDR if not set
+	Address string `json:"address,omitempty"`
+	//Namespace is the Vault Enterprise namespace, VAULT_NAMESPACE if not set
+	Namespace string `json:"namespace,omitempty"`
+	//Mount is the path of the KV v2 engine, secret if not set
+	Mount      string `json:"mount,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	//Token is VAULT_TOKEN if not set
+	Token   string  `json:"token,omitempty"`
+	AppRole AppRole `json:"approle,omitempty"`
+}
+
+//AppRole credentials of the Vault approle auth method
+type AppRole struct {
+	//Mount is the path of the auth method, approle if not set
+	Mount  string `json:"mount,omitempty"`
+	RoleID string `json:"role_id,omitempty"`
+	//SecretID is VAULT_SECRET_ID if not set
+	SecretID string `json:"secret_id,omitempty"`
+}
+
+//AWS Secrets Manager, the secret of a user is named <Prefix><secret id>.
+//The credentials are the ones of the AWS_* environment variables when they are not set.
+type AWS struct {
+	//Region is AWS_REGION or AWS_DEFAULT_REGION if not set
+	Region string `json:"region,omitempty"`
+	//Endpoint is https://secretsmanager.<Region>.amazonaws.com if not set
+	Endpoint        string `json:"endpoint,omitempty"`
+	Prefix          string `json:"prefix,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+	//KMSKeyID encrypts the created secrets, the aws/secretsmanager key if not set
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+	//Tags are added to the tags of every secret
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+//Azure Key Vault, the secret of a user is named <Prefix><secret id> with _ replaced by -.
+//It authenticates as a service principal with a client secret, the AZURE_* environment variables are used when not set.
+type Azure struct {
+	//VaultURL is the vault eg: https://my-vault.vault.azure.net
+	VaultURL string `json:"vault_url,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	//TenantID is AZURE_TENANT_ID if not set
+	TenantID string `json:"tenant_id,omitempty"`
+	//ClientID is AZURE_CLIENT_ID if not set
+	ClientID string `json:"client_id,omitempty"`
+	//ClientSecret is AZURE_CLIENT_SECRET if not set
+	ClientSecret string `json:"client_secret,omitempty"`
+	//AuthorityHost is https://login.microsoftonline.com if not set
+	AuthorityHost string `json:"authority_host,omitempty"`
+	//Tags are added to the tags of every secret
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+//File is a local file encrypted with AES-GCM, for development and air-gapped sites.
+//The key is derived from the content of KeyFile if it is set, from Passphrase otherwise.
+type File struct {
+	//Path is secrets.enc if not set
+	Path    string `json:"path,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+	//Passphrase is MONGO_UTIL_SECRETS_PASSPHRASE if not set
+	Passphrase string `json:"passphrase,omitempty"`
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	configuration "mongo-util/config"
+	"regexp"
+)
+
+//userFilter is the compiled form of configuration.UserFilter, nil patterns match everything
+type userFilter struct {
+	includeUsers, excludeUsers         *regexp.Regexp
+	includeDatabases, excludeDatabases *regexp.Regexp
+	includeRoles, excludeRoles         *regexp.Regexp
+	includeScopes, excludeScopes       *regexp.Regexp
+}
+
+//rotationFilter resolves the filter of a project: config.json defaults, then the project entry, then the flags
+func rotationFilter(projectName string, flags configuration.UserFilter) (*userFilter, error) {
+	filter := config.Rotation.Filter
+	if project, ok := config.Rotation.Projects[projectName]; ok {
+		filter = filter.Merge(project.Filter)
+	}
+	return compileFilter(filter.Merge(flags))
+}
+
+func compileFilter(filter configuration.UserFilter) (*userFilter, error) {
+	var compiled userFilter
+	patterns := []struct {
+		name    string
+		pattern string
+		target  **regexp.Regexp
+	}{
+		{IncludeUsers, filter.IncludeUsers, &compiled.includeUsers},
+		{ExcludeUsers, filter.ExcludeUsers, &compiled.excludeUsers},
+		{IncludeDatabases, filter.IncludeDatabases, &compiled.includeDatabases},
+		{ExcludeDatabases, filter.ExcludeDatabases, &compiled.excludeDatabases},
+		{IncludeRoles, filter.IncludeRoles, &compiled.includeRoles},
+		{ExcludeRoles, filter.ExcludeRoles, &compiled.excludeRoles},
+		{IncludeScopes, filter.IncludeScopes, &compiled.includeScopes},
+		{ExcludeScopes, filter.ExcludeScopes, &compiled.excludeScopes},
+	}
+	for _, p := range patterns {
+		if p.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", p.name, p.pattern, err)
+		}
+		*p.target = re
+	}
+	return &compiled, nil
+}
+
+//excludedBy tells which filter leaves the user out of the rotation, empty if the user is selected
+func (f *userFilter) excludedBy(user configuration.MongoUser) string {
+	if f == nil {
+		return ""
+	}
+	var roles, scopes []string
+	for _, role := range user.Roles {
+		roles = append(roles, role.String())
+	}
+	for _, scope := range user.Scopes {
+		scopes = append(scopes, scope.Name)
+	}
+
+	checks := []struct {
+		name    string
+		re      *regexp.Regexp
+		values  []string
+		include bool
+	}{
+		{IncludeUsers, f.includeUsers, []string{user.Username}, true},
+		{ExcludeUsers, f.excludeUsers, []string{user.Username}, false},
+		{IncludeDatabases, f.includeDatabases, []string{user.DBName}, true},
+		{ExcludeDatabases, f.excludeDatabases, []string{user.DBName}, false},
+		{IncludeRoles, f.includeRoles, roles, true},
+		{ExcludeRoles, f.excludeRoles, roles, false},
+		{IncludeScopes, f.includeScopes, scopes, true},
+		{ExcludeScopes, f.excludeScopes, scopes, false},
+	}
+	for _, check := range checks {
+		if check.re == nil {
+			continue
+		}
+		if matchAny(check.re, check.values) != check.include {
+			return check.name
+		}
+	}
+	return ""
+}
+
+func matchAny(re *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
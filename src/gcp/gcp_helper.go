@@ -1,81 +1,322 @@
 package gcp
 
 import (
+	"bytes"
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"context"
 	"fmt"
+	"google.golang.org/api/iterator"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"hash/crc32"
 	"log"
 	configuration "mongo-util/config"
+	secrets "mongo-util/secrets"
+	"strings"
 )
 
-// saveSecret adds a new secret version to the given secret with the
-// provided payload.
-func SaveSecret(config configuration.Config, user configuration.MongoUser, secretStr string) error {
-	secretId := user.ProjectID + "-" + user.Username
-	// Create the client.
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
+//Client holds a single secret manager connection, so that it can be shared by all the users of a run
+type Client struct {
+	config configuration.Config
+	client *secretmanager.Client
+}
+
+//Client is the GCP secret store, it stages the new versions, prunes the old ones and saves the API keys
+var (
+	_ secrets.Store   = (*Client)(nil)
+	_ secrets.Stager  = (*Client)(nil)
+	_ secrets.Pruner  = (*Client)(nil)
+	_ secrets.IDSaver = (*Client)(nil)
+)
 
+//NewClient creates the secret manager client, GOOGLE_APPLICATION_CREDENTIALS is expected to be set
+func NewClient(ctx context.Context, config configuration.Config) (*Client, error) {
+	//the created secrets get these settings, a wrong one must not reach the API halfway through a run
+	if err := config.GCP.ValidateSecretSettings(); err != nil {
+		return nil, err
+	}
+	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
-		log.Fatalf("failed to setup client: %v", err)
+		return nil, fmt.Errorf("failed to setup client: %v", err)
 	}
-	defer client.Close()
+	return &Client{config: config, client: client}, nil
+}
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+//ensureSecret creates a secret if it doesn't exist yet and returns its name. The labels and annotations
+//are set on creation and refreshed on an existing secret, user is nil for the secrets of no db user.
+func (c *Client) ensureSecret(ctx context.Context, secretID string, user *configuration.MongoUser) (string, error) {
+	labels, annotations := secretMetadata(c.config, user)
 
 	// Create the request to create the secret.
 	createSecretReq := &secretmanagerpb.CreateSecretRequest{
-		Parent:   fmt.Sprintf("projects/%s", config.GCP.ProjectID),
-		SecretId: secretId,
-		Secret: &secretmanagerpb.Secret{
-			Replication: &secretmanagerpb.Replication{
-				Replication: &secretmanagerpb.Replication_Automatic_{
-					Automatic: &secretmanagerpb.Replication_Automatic{},
-				},
-			},
-		},
+		Parent:   fmt.Sprintf("projects/%s", c.config.GCP.ProjectID),
+		SecretId: secretID,
+		Secret:   newSecret(c.config, labels, annotations),
+	}
+
+	secret, err := c.client.CreateSecret(ctx, createSecretReq)
+	if err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			name := secretName(c.config, secretID)
+			return name, c.updateMetadata(ctx, name, labels, annotations)
+		}
+		return "", fmt.Errorf("failed to create secret: %v", err)
+	}
+	return secret.Name, nil
+}
+
+//updateMetadata merges labels and annotations into the ones of an existing secret,
+//its expiration is pushed back when gcp.ttl is set
+func (c *Client) updateMetadata(ctx context.Context, name string, labels, annotations map[string]string) error {
+	secret, err := c.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: name})
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s: %v", name, err)
+	}
+	if secret.Labels == nil {
+		secret.Labels = make(map[string]string)
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	for key, value := range labels {
+		secret.Labels[key] = value
+	}
+	for key, value := range annotations {
+		secret.Annotations[key] = value
 	}
 
-	parent := ""
-	secret, err := client.CreateSecret(ctx, createSecretReq)
+	update := &secretmanagerpb.Secret{Name: name, Labels: secret.Labels, Annotations: secret.Annotations, Etag: secret.Etag}
+	paths := []string{"labels", "annotations"}
+	if expiration := ttl(c.config); expiration != nil {
+		update.Expiration = expiration
+		paths = append(paths, "ttl")
+	}
+	_, err = c.client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret:     update,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
 	if err != nil {
-		//log.Println("WARNING: %v", err)
-		parent = createSecretReq.Parent + "/secrets/" + secretId
-	} else {
-		parent = secret.Name
+		return fmt.Errorf("failed to update labels of secret %s: %v", name, err)
 	}
+	return nil
+}
 
-	// Declare the payload to store.
-	payload := []byte(secretStr)
+//crc32cTable is the Castagnoli table Secret Manager checksums the payloads with
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
-	// Build the request.
-	addSecretVersionReq := &secretmanagerpb.AddSecretVersionRequest{
+//addVersion adds a new enabled secret version with the provided payload and returns its name.
+//The payload is sent with its CRC32C checksum, for Secret Manager to reject it if it is altered on the way,
+//and read back: a version whose payload differs is destroyed so that it is never served.
+func (c *Client) addVersion(ctx context.Context, secretID string, user *configuration.MongoUser, secretStr string) (string, error) {
+	parent, err := c.ensureSecret(ctx, secretID, user)
+	if err != nil {
+		return "", err
+	}
+
+	data := []byte(secretStr)
+	checksum := int64(crc32.Checksum(data, crc32cTable))
+	version, err := c.client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
 		Parent: parent,
 		Payload: &secretmanagerpb.SecretPayload{
-			Data: payload,
+			Data:       data,
+			DataCrc32C: &checksum,
 		},
+	})
+	if err != nil {
+		if status.Code(err) == codes.InvalidArgument && strings.Contains(strings.ToLower(err.Error()), "checksum") {
+			return "", fmt.Errorf("failed to add secret version: %w: %v", secrets.ErrSecretMismatch, err)
+		}
+		return "", fmt.Errorf("failed to add secret version: %v", err)
+	}
+
+	if err := c.verifyVersion(ctx, version.Name, data, checksum); err != nil {
+		if dErr := c.DestroyVersion(ctx, version.Name); dErr != nil {
+			//the caller destroys the version it gets back with an error
+			return version.Name, fmt.Errorf("%w, %v", err, dErr)
+		}
+		log.Printf("destroyed the secret version %s which doesn't hold what was written", version.Name)
+		return "", err
 	}
+	return version.Name, nil
+}
 
-	// Call the API.
-	version, err := client.AddSecretVersion(ctx, addSecretVersionReq)
+//verifyVersion reads a version back and compares its payload and checksum with what was written
+func (c *Client) verifyVersion(ctx context.Context, name string, data []byte, checksum int64) error {
+	result, err := c.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
 	if err != nil {
-		log.Fatalf("failed to add secret version: %v", err)
+		return fmt.Errorf("failed to read back secret version %s: %v", name, err)
+	}
+	read := result.GetPayload()
+	switch {
+	case read.DataCrc32C != nil && read.GetDataCrc32C() != checksum:
+		return fmt.Errorf("secret version %s: %w, crc32c %d instead of %d", name, secrets.ErrSecretMismatch, read.GetDataCrc32C(), checksum)
+	case int64(crc32.Checksum(read.GetData(), crc32cTable)) != checksum || !bytes.Equal(read.GetData(), data):
+		return fmt.Errorf("secret version %s: %w, the payload read back differs", name, secrets.ErrSecretMismatch)
 	}
+	return nil
+}
 
-	// Build the request.
-	accessRequest := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: version.Name,
+//SaveSecret adds a new enabled secret version to the secret of a given user
+func (c *Client) SaveSecret(ctx context.Context, user configuration.MongoUser, secretStr string) (string, error) {
+	secretID, err := secrets.SecretID(c.config, user)
+	if err != nil {
+		return "", err
 	}
+	return c.addVersion(ctx, secretID, &user, secretStr)
+}
 
-	// Call the API.
-	_, err = client.AccessSecretVersion(ctx, accessRequest)
+//SaveSecretByID adds a new enabled secret version to a secret which doesn't belong to a db user
+func (c *Client) SaveSecretByID(ctx context.Context, secretID string, secretStr string) (string, error) {
+	if err := secrets.ValidSecretID(secretID); err != nil {
+		return "", err
+	}
+	return c.addVersion(ctx, secretID, nil, secretStr)
+}
+
+//StageSecret adds a new secret version and disables it right away, so that it is persisted
+//but not served until EnableVersion is called. The name of the staged version is returned.
+//Secret Manager can't add a disabled version: until it is disabled, the latest enabled version is the new one
+//and a reader gets a password Atlas doesn't have yet. A version which can't be disabled is destroyed,
+//its name is returned with the error only if that fails too, for the caller to destroy it.
+func (c *Client) StageSecret(ctx context.Context, user configuration.MongoUser, secretStr string) (string, error) {
+	secretID, err := secrets.SecretID(c.config, user)
+	if err != nil {
+		return "", err
+	}
+	name, err := c.addVersion(ctx, secretID, &user, secretStr)
 	if err != nil {
-		log.Fatalf("failed to access secret version: %v", err)
+		return name, err
+	}
+	if _, err := c.client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: name}); err != nil {
+		err = fmt.Errorf("failed to disable staged secret version %s: %v", name, err)
+		if dErr := c.DestroyVersion(ctx, name); dErr != nil {
+			return name, fmt.Errorf("%v, %v", err, dErr)
+		}
+		log.Printf("destroyed the secret version %s which could not be staged", name)
+		return "", err
 	}
+	return name, nil
+}
 
-	// Print the secret payload.
-	// WARNING: Do not print the secret in a production environment - this
-	// snippet is showing how to access the secret material.
+//EnableVersion makes a staged secret version the current one
+func (c *Client) EnableVersion(ctx context.Context, name string) error {
+	if _, err := c.client.EnableSecretVersion(ctx, &secretmanagerpb.EnableSecretVersionRequest{Name: name}); err != nil {
+		return fmt.Errorf("failed to enable secret version %s: %v", name, err)
+	}
+	return nil
+}
 
-	//log.Printf("Read secret from GCP: %s", result.Payload.Data)
+//DestroyVersion irreversibly destroys the payload of a secret version
+func (c *Client) DestroyVersion(ctx context.Context, name string) error {
+	if _, err := c.client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{Name: name}); err != nil {
+		return fmt.Errorf("failed to destroy secret version %s: %v", name, err)
+	}
+	return nil
+}
+
+//DeleteSecret deletes the secret of a given user with all its versions
+func (c *Client) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	name, err := SecretName(c.config, user)
+	if err != nil {
+		return err
+	}
+	err = c.client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: name})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("failed to delete secret %s: %v", name, err)
+	}
 	return nil
 }
+
+//ListVersions lists the versions of the secret of a given user newest first, destroyed versions are left out
+func (c *Client) ListVersions(ctx context.Context, user configuration.MongoUser) ([]secrets.Version, error) {
+	name, err := SecretName(c.config, user)
+	if err != nil {
+		return nil, err
+	}
+	var versions []secrets.Version
+	it := c.client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{Parent: name})
+	for {
+		version, err := it.Next()
+		if err == iterator.Done || status.Code(err) == codes.NotFound {
+			return versions, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list secret versions: %v", err)
+		}
+		if version.State == secretmanagerpb.SecretVersion_DESTROYED {
+			continue
+		}
+		versions = append(versions, secrets.Version{
+			Name:    version.Name,
+			Created: version.CreateTime.AsTime(),
+			Enabled: version.State == secretmanagerpb.SecretVersion_ENABLED,
+		})
+	}
+}
+
+//latestVersion is the newest enabled version of the secret of a given user
+func (c *Client) latestVersion(ctx context.Context, user configuration.MongoUser) (*secretmanagerpb.SecretVersion, error) {
+	name, err := SecretName(c.config, user)
+	if err != nil {
+		return nil, err
+	}
+	it := c.client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{
+		Parent: name,
+		Filter: "state:ENABLED",
+	})
+	//versions are listed newest first
+	version, err := it.Next()
+	if err == iterator.Done || status.Code(err) == codes.NotFound {
+		return nil, secrets.ErrNoSecretVersion
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secret versions: %v", err)
+	}
+	return version, nil
+}
+
+//LatestSecret reads the payload of the newest enabled version of the secret of a given user,
+//ErrNoSecretVersion is returned if there is none
+func (c *Client) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	version, err := c.latestVersion(ctx, user)
+	if err != nil {
+		return "", "", err
+	}
+
+	result, err := c.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: version.Name})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to access secret version %s: %v", version.Name, err)
+	}
+	return version.Name, string(result.Payload.Data), nil
+}
+
+//AccessSecret reads the payload of a secret version by resource name,
+//eg: projects/<project>/secrets/<secret id>/versions/latest
+func (c *Client) AccessSecret(ctx context.Context, name string) (string, error) {
+	result, err := c.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("failed to access secret version %s: %v", name, err)
+	}
+	return string(result.Payload.Data), nil
+}
+
+//SaveSecret adds a new secret version to the secret of a given user with the provided payload,
+//it opens a client of its own, prefer Client.SaveSecret when saving several secrets.
+func SaveSecret(config configuration.Config, user configuration.MongoUser, secretStr string) error {
+	ctx := context.Background()
+	client, err := NewClient(ctx, config)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.SaveSecret(ctx, user, secretStr)
+	return err
+}
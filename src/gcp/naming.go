@@ -0,0 +1,56 @@
+package gcp
+
+import (
+	"fmt"
+	configuration "mongo-util/config"
+	secrets "mongo-util/secrets"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//label values may only have lowercase letters, digits, _ and -, up to 63 characters
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+//SecretName is the full resource name of the secret of a given user
+func SecretName(config configuration.Config, user configuration.MongoUser) (string, error) {
+	id, err := secrets.SecretID(config, user)
+	if err != nil {
+		return "", err
+	}
+	return secretName(config, id), nil
+}
+
+func secretName(config configuration.Config, secretID string) string {
+	return fmt.Sprintf("projects/%s/secrets/%s", config.GCP.ProjectID, secretID)
+}
+
+//labelValue turns any value into a valid label value
+func labelValue(value string) string {
+	value = invalidLabelChars.ReplaceAllString(strings.ToLower(value), "_")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return value
+}
+
+//secretMetadata are the labels, to search the secrets, and the annotations, to read them, of a secret.
+//user is nil for the secrets which don't belong to a db user.
+func secretMetadata(config configuration.Config, user *configuration.MongoUser) (map[string]string, map[string]string) {
+	labels := map[string]string{
+		"rotated-by": labelValue(secrets.RotatedBy()),
+		"rotated-at": strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if config.GCP.Env != "" {
+		labels["env"] = labelValue(config.GCP.Env)
+	}
+	if user != nil {
+		labels["project"] = labelValue(secrets.ProjectName(config, *user))
+		labels["project-id"] = labelValue(user.ProjectID)
+	}
+	for key, value := range config.GCP.Labels {
+		labels[key] = value
+	}
+	return labels, secrets.Annotations(config, user)
+}
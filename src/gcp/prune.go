@@ -0,0 +1,112 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/iterator"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	configuration "mongo-util/config"
+	secrets "mongo-util/secrets"
+	"time"
+)
+
+//Prune applies the retention policy to the secret of a given user
+func (c *Client) Prune(ctx context.Context, user configuration.MongoUser, retention configuration.Retention, dryRun bool) ([]secrets.PruneAction, error) {
+	name, err := SecretName(c.config, user)
+	if err != nil {
+		return nil, err
+	}
+	return c.PruneSecret(ctx, name, retention, dryRun)
+}
+
+//PruneSecret applies the retention policy to the versions of a secret, with dryRun the actions are only returned.
+//The newest enabled version is always kept, so the current password stays readable.
+func (c *Client) PruneSecret(ctx context.Context, name string, retention configuration.Retention, dryRun bool) ([]secrets.PruneAction, error) {
+	plan, err := c.prunePlan(ctx, name, retention)
+	if err != nil || dryRun {
+		return plan, err
+	}
+	for i, action := range plan {
+		switch action.Action {
+		case secrets.PruneDisable:
+			_, err = c.client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: action.Version})
+			if err != nil {
+				err = fmt.Errorf("failed to disable secret version %s: %v", action.Version, err)
+			}
+		case secrets.PruneDestroy:
+			err = c.DestroyVersion(ctx, action.Version)
+		}
+		if err != nil {
+			//the actions before the failing one are applied
+			return plan[:i], err
+		}
+	}
+	return plan, nil
+}
+
+//prunePlan lists the versions of a secret, newest first, and picks the ones to disable or destroy
+func (c *Client) prunePlan(ctx context.Context, name string, retention configuration.Retention) ([]secrets.PruneAction, error) {
+	destroyBefore := time.Time{}
+	if retention.DestroyAfterDays > 0 {
+		destroyBefore = time.Now().Add(-time.Duration(retention.DestroyAfterDays) * 24 * time.Hour)
+	}
+
+	var plan []secrets.PruneAction
+	enabled := 0
+	it := c.client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{Parent: name})
+	for {
+		version, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of secret %s: %v", name, err)
+		}
+		if version.State == secretmanagerpb.SecretVersion_DESTROYED {
+			continue
+		}
+		if version.State == secretmanagerpb.SecretVersion_ENABLED {
+			enabled++
+			if enabled == 1 || enabled <= retention.KeepVersions {
+				continue
+			}
+		}
+
+		action := secrets.PruneAction{Version: version.Name, Created: version.CreateTime.AsTime()}
+		switch {
+		case !destroyBefore.IsZero() && action.Created.Before(destroyBefore):
+			action.Action = secrets.PruneDestroy
+		case version.State == secretmanagerpb.SecretVersion_ENABLED && retention.KeepVersions > 0:
+			action.Action = secrets.PruneDisable
+		default:
+			continue
+		}
+		plan = append(plan, action)
+	}
+	return plan, nil
+}
+
+//ManagedSecrets lists the names of the secrets labelled by this tool, only the ones of projectName if it is set.
+//Secrets saved before they were labelled get their labels at their next rotation.
+func (c *Client) ManagedSecrets(ctx context.Context, projectName string) ([]string, error) {
+	filter := "labels.rotated-by:*"
+	if projectName != "" {
+		filter = fmt.Sprintf("labels.project=%s", labelValue(projectName))
+	}
+	it := c.client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{
+		Parent: fmt.Sprintf("projects/%s", c.config.GCP.ProjectID),
+		Filter: filter,
+	})
+	var names []string
+	for {
+		secret, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list secrets: %v", err)
+		}
+		names = append(names, secret.Name)
+	}
+	return names, nil
+}
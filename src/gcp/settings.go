@@ -0,0 +1,189 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	configuration "mongo-util/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+//SettingChange is a setting of an existing secret which differs from gcp in config.json
+type SettingChange struct {
+	Setting string
+	Current string
+	Wanted  string
+	//Fixable is false for the locations of the replicas, they can't change once the secret is created
+	Fixable bool
+}
+
+//replication is the replication of the created secrets
+func replication(config configuration.Config) *secretmanagerpb.Replication {
+	settings := config.GCP.Replication
+	if len(settings.Replicas) == 0 {
+		automatic := &secretmanagerpb.Replication_Automatic{}
+		if settings.KMSKeyName != "" {
+			automatic.CustomerManagedEncryption = &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: settings.KMSKeyName}
+		}
+		return &secretmanagerpb.Replication{Replication: &secretmanagerpb.Replication_Automatic_{Automatic: automatic}}
+	}
+	userManaged := &secretmanagerpb.Replication_UserManaged{}
+	for _, replica := range settings.Replicas {
+		r := &secretmanagerpb.Replication_UserManaged_Replica{Location: replica.Location}
+		if replica.KMSKeyName != "" {
+			r.CustomerManagedEncryption = &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: replica.KMSKeyName}
+		}
+		userManaged.Replicas = append(userManaged.Replicas, r)
+	}
+	return &secretmanagerpb.Replication{Replication: &secretmanagerpb.Replication_UserManaged_{UserManaged: userManaged}}
+}
+
+//topics are the Pub/Sub topics of the secrets
+func topics(config configuration.Config) []*secretmanagerpb.Topic {
+	var topics []*secretmanagerpb.Topic
+	for _, name := range config.GCP.Topics {
+		topics = append(topics, &secretmanagerpb.Topic{Name: name})
+	}
+	return topics
+}
+
+//rotation schedules the SECRET_ROTATE notifications, nil without rotation_period.
+//The settings are checked by GCP.ValidateSecretSettings.
+func rotation(config configuration.Config) *secretmanagerpb.Rotation {
+	if config.GCP.RotationPeriod == "" {
+		return nil
+	}
+	period, _ := configuration.ParseAge(config.GCP.RotationPeriod)
+	return &secretmanagerpb.Rotation{
+		NextRotationTime: timestamppb.New(time.Now().Add(period)),
+		RotationPeriod:   durationpb.New(period),
+	}
+}
+
+//ttl is the expiration of a secret which isn't rotated, nil without ttl
+func ttl(config configuration.Config) *secretmanagerpb.Secret_Ttl {
+	if config.GCP.TTL == "" {
+		return nil
+	}
+	age, _ := configuration.ParseAge(config.GCP.TTL)
+	return &secretmanagerpb.Secret_Ttl{Ttl: durationpb.New(age)}
+}
+
+//newSecret is a secret to create with the settings of gcp in config.json
+func newSecret(config configuration.Config, labels, annotations map[string]string) *secretmanagerpb.Secret {
+	secret := &secretmanagerpb.Secret{
+		Replication: replication(config),
+		Labels:      labels,
+		Annotations: annotations,
+		Topics:      topics(config),
+		Rotation:    rotation(config),
+	}
+	if expiration := ttl(config); expiration != nil {
+		secret.Expiration = expiration
+	}
+	return secret
+}
+
+//replicaKeys describes the locations and keys of a replication: automatic[/key] or location[=key],...
+func replicaKeys(replication *secretmanagerpb.Replication) (string, string) {
+	if automatic := replication.GetAutomatic(); automatic != nil {
+		return "automatic", automatic.GetCustomerManagedEncryption().GetKmsKeyName()
+	}
+	var locations, keys []string
+	for _, replica := range replication.GetUserManaged().GetReplicas() {
+		locations = append(locations, replica.Location)
+		keys = append(keys, replica.Location+"="+replica.GetCustomerManagedEncryption().GetKmsKeyName())
+	}
+	sort.Strings(locations)
+	sort.Strings(keys)
+	return strings.Join(locations, ","), strings.Join(keys, ",")
+}
+
+//settingChanges compares an existing secret with the settings of gcp in config.json, the update is the secret
+//and the mask paths fixing the fixable changes
+func settingChanges(config configuration.Config, secret *secretmanagerpb.Secret) ([]SettingChange, *secretmanagerpb.Secret, []string) {
+	var changes []SettingChange
+	update := &secretmanagerpb.Secret{Name: secret.Name, Etag: secret.Etag}
+	var paths []string
+
+	wanted := replication(config)
+	currentLocations, currentKeys := replicaKeys(secret.Replication)
+	wantedLocations, wantedKeys := replicaKeys(wanted)
+	switch {
+	case currentLocations != wantedLocations:
+		changes = append(changes, SettingChange{Setting: "replication", Current: currentLocations, Wanted: wantedLocations})
+	case currentKeys != wantedKeys:
+		changes = append(changes, SettingChange{Setting: "kms keys", Current: currentKeys, Wanted: wantedKeys, Fixable: true})
+		update.Replication = wanted
+		if wanted.GetAutomatic() != nil {
+			paths = append(paths, "replication.automatic.customer_managed_encryption")
+		} else {
+			paths = append(paths, "replication.user_managed.replicas.customer_managed_encryption")
+		}
+	}
+
+	//the expiration of an existing secret is pushed back by the rotations, only a missing or unwanted one is fixed
+	switch {
+	case config.GCP.TTL != "" && secret.GetExpireTime() == nil:
+		changes = append(changes, SettingChange{Setting: "expiration", Current: "none", Wanted: "ttl " + config.GCP.TTL, Fixable: true})
+		update.Expiration = ttl(config)
+		paths = append(paths, "ttl")
+	case config.GCP.TTL == "" && secret.GetExpireTime() != nil:
+		changes = append(changes, SettingChange{Setting: "expiration", Current: secret.GetExpireTime().AsTime().Format(time.RFC3339), Wanted: "none", Fixable: true})
+		paths = append(paths, "expire_time")
+	}
+
+	var currentTopics []string
+	for _, topic := range secret.Topics {
+		currentTopics = append(currentTopics, topic.Name)
+	}
+	wantedTopics := append([]string{}, config.GCP.Topics...)
+	sort.Strings(currentTopics)
+	sort.Strings(wantedTopics)
+	if strings.Join(currentTopics, ",") != strings.Join(wantedTopics, ",") {
+		changes = append(changes, SettingChange{Setting: "topics", Current: strings.Join(currentTopics, ","), Wanted: strings.Join(wantedTopics, ","), Fixable: true})
+		update.Topics = topics(config)
+		paths = append(paths, "topics")
+	}
+
+	currentPeriod, wantedPeriod := "", ""
+	if period := secret.GetRotation().GetRotationPeriod(); period != nil {
+		currentPeriod = period.AsDuration().String()
+	}
+	wantedRotation := rotation(config)
+	if wantedRotation != nil {
+		wantedPeriod = wantedRotation.RotationPeriod.AsDuration().String()
+	}
+	if currentPeriod != wantedPeriod {
+		changes = append(changes, SettingChange{Setting: "rotation period", Current: currentPeriod, Wanted: wantedPeriod, Fixable: true})
+		update.Rotation = wantedRotation
+		paths = append(paths, "rotation")
+	}
+	return changes, update, paths
+}
+
+//ReconcileSecret compares a secret with the replication, ttl, topics and rotation_period of gcp in config.json and,
+//unless dryRun is set, fixes what can change on an existing secret. The differences are returned.
+func (c *Client) ReconcileSecret(ctx context.Context, name string, dryRun bool) ([]SettingChange, error) {
+	secret, err := c.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s: %v", name, err)
+	}
+	changes, update, paths := settingChanges(c.config, secret)
+	if dryRun || len(paths) == 0 {
+		return changes, nil
+	}
+	_, err = c.client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret:     update,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return changes, fmt.Errorf("failed to update the settings of secret %s: %v", name, err)
+	}
+	return changes, nil
+}
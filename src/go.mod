@@ -3,8 +3,13 @@ module mongo-util
 go 1.16
 
 require (
-	cloud.google.com/go/secretmanager v1.4.0
+	cloud.google.com/go/secretmanager v1.10.0
 	github.com/mongodb-forks/digest v1.0.3
 	go.mongodb.org/mongo-driver v1.9.0
-	google.golang.org/genproto v0.0.0-20220413183235-5e96e2839df9
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	google.golang.org/api v0.103.0
+	google.golang.org/genproto v0.0.0-20221201164419-0e50fba7f41c
+	google.golang.org/grpc v1.51.0
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,226 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	configuration "mongo-util/config"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//serviceAccountDir holds the token, the CA and the namespace of the pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+//DefaultNamespace is used when neither the config nor the context sets one
+const DefaultNamespace = "default"
+
+//Client is a minimal Kubernetes API client, only what is needed to write Secrets and restart Deployments
+type Client struct {
+	rest   *restConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+//Error is returned when the API server answers with an error Status
+type Error struct {
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kubernetes returned %d %s: %s", e.StatusCode, e.Reason, e.Message)
+}
+
+//IsNotFound tells if err is a missing object
+func IsNotFound(err error) bool {
+	kubeErr, ok := err.(*Error)
+	return ok && kubeErr.StatusCode == http.StatusNotFound
+}
+
+//NewClient uses the in-cluster service account when running in a pod without a kubeconfig, the kubeconfig otherwise
+func NewClient(config configuration.Kubernetes) (*Client, error) {
+	var rc *restConfig
+	var err error
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" && config.Kubeconfig == "" && os.Getenv("KUBECONFIG") == "" {
+		rc, err = inClusterConfig(host, os.Getenv("KUBERNETES_SERVICE_PORT"))
+	} else {
+		rc, err = loadKubeconfig(kubeconfigPath(config.Kubeconfig), config.Context)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rc.server == "" {
+		return nil, fmt.Errorf("kubernetes API server is unknown")
+	}
+	if config.Namespace != "" {
+		rc.namespace = config.Namespace
+	}
+	if rc.namespace == "" {
+		rc.namespace = DefaultNamespace
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: rc.insecure}
+	if len(rc.caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rc.caData) {
+			return nil, fmt.Errorf("invalid kubernetes certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(rc.certData) > 0 {
+		cert, err := tls.X509KeyPair(rc.certData, rc.keyData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubernetes client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &Client{
+		rest:   rc,
+		client: &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}},
+	}, nil
+}
+
+//inClusterConfig reads the service account mounted in the pod, the token is read again before every call
+//as it is rotated by the kubelet
+func inClusterConfig(host, port string) (*restConfig, error) {
+	caData, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read the service account: %v", err)
+	}
+	rc := &restConfig{server: "https://" + host, caData: caData, tokenFile: serviceAccountDir + "/token"}
+	if strings.Contains(host, ":") {
+		rc.server = "https://[" + host + "]"
+	}
+	if port != "" {
+		rc.server += ":" + port
+	}
+	if namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+		rc.namespace = strings.TrimSpace(string(namespace))
+	}
+	return rc, nil
+}
+
+//Namespace is the namespace the objects are written to when none is given
+func (c *Client) Namespace() string {
+	return c.rest.namespace
+}
+
+//bearerToken is the token of the request, empty when the client authenticates with a certificate
+func (c *Client) bearerToken(ctx context.Context) (string, error) {
+	switch {
+	case c.rest.token != "":
+		return c.rest.token, nil
+	case c.rest.tokenFile != "":
+		token, err := ioutil.ReadFile(c.rest.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read kubernetes token: %v", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	case c.rest.exec != nil:
+		return c.execToken(ctx)
+	}
+	return "", nil
+}
+
+//execToken runs the credential plugin of the kubeconfig, its token is reused until a minute before it expires
+func (c *Client) execToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.expires.IsZero() || time.Now().Add(time.Minute).Before(c.expires)) {
+		return c.token, nil
+	}
+
+	plugin := c.rest.exec
+	cmd := exec.CommandContext(ctx, plugin.Command, plugin.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range plugin.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	execInfo, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": plugin.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]bool{"interactive": false},
+	})
+	cmd.Env = append(cmd.Env, "KUBERNETES_EXEC_INFO="+string(execInfo))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("kubernetes credential plugin %s: %v %s", plugin.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	var credential struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &credential); err != nil || credential.Status.Token == "" {
+		return "", fmt.Errorf("kubernetes credential plugin %s returned no token", plugin.Command)
+	}
+	c.token, c.expires = credential.Status.Token, credential.Status.ExpirationTimestamp
+	return c.token, nil
+}
+
+//call sends a request to the API server and decodes the response into out
+func (c *Client) call(ctx context.Context, method, apiPath, contentType string, payload, out interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.rest.server+apiPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	token, err := c.bearerToken(ctx)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		kubeErr := &Error{StatusCode: resp.StatusCode}
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) == nil {
+			kubeErr.Reason, kubeErr.Message = status.Reason, status.Message
+		}
+		return kubeErr
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decode kubernetes response: %v", err)
+		}
+	}
+	return nil
+}
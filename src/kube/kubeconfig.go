@@ -0,0 +1,164 @@
+package kube
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//kubeconfig is the part of a kubeconfig file the client uses
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User authInfo `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+//authInfo are the credentials of a kubeconfig user
+type authInfo struct {
+	Token                 string      `yaml:"token"`
+	TokenFile             string      `yaml:"tokenFile"`
+	ClientCertificate     string      `yaml:"client-certificate"`
+	ClientCertificateData string      `yaml:"client-certificate-data"`
+	ClientKey             string      `yaml:"client-key"`
+	ClientKeyData         string      `yaml:"client-key-data"`
+	Exec                  *execConfig `yaml:"exec"`
+}
+
+//execConfig is a credential plugin, eg: gke-gcloud-auth-plugin
+type execConfig struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	Env        []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"env"`
+}
+
+//restConfig is how to reach and authenticate to the API server
+type restConfig struct {
+	server    string
+	namespace string
+	caData    []byte
+	insecure  bool
+	certData  []byte
+	keyData   []byte
+	token     string
+	tokenFile string
+	exec      *execConfig
+}
+
+//kubeconfigPath resolves the kubeconfig file: the configured one, the first one of KUBECONFIG or ~/.kube/config
+func kubeconfigPath(path string) string {
+	if path != "" {
+		return path
+	}
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0]
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kube", "config")
+}
+
+//loadKubeconfig reads the cluster, the user and the namespace of a context, the current one if contextName is empty
+func loadKubeconfig(path, contextName string) (*restConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig: %v", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("parse kubeconfig %s: %v", path, err)
+	}
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	//relative files of a kubeconfig are relative to the kubeconfig itself
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.Dir(path), file)
+	}
+
+	rc := &restConfig{}
+	found := false
+	var clusterName, userName string
+	for _, context := range kc.Contexts {
+		if context.Name == contextName {
+			found = true
+			clusterName, userName, rc.namespace = context.Context.Cluster, context.Context.User, context.Context.Namespace
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", contextName, path)
+	}
+
+	found = false
+	for _, cluster := range kc.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		found = true
+		rc.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		rc.insecure = cluster.Cluster.InsecureSkipTLSVerify
+		if rc.caData, err = fileOrData(resolve(cluster.Cluster.CertificateAuthority), cluster.Cluster.CertificateAuthorityData); err != nil {
+			return nil, fmt.Errorf("certificate authority of cluster %s: %v", clusterName, err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+
+	for _, user := range kc.Users {
+		if user.Name != userName {
+			continue
+		}
+		auth := user.User
+		rc.token, rc.tokenFile, rc.exec = auth.Token, resolve(auth.TokenFile), auth.Exec
+		if rc.certData, err = fileOrData(resolve(auth.ClientCertificate), auth.ClientCertificateData); err != nil {
+			return nil, fmt.Errorf("client certificate of user %s: %v", userName, err)
+		}
+		if rc.keyData, err = fileOrData(resolve(auth.ClientKey), auth.ClientKeyData); err != nil {
+			return nil, fmt.Errorf("client key of user %s: %v", userName, err)
+		}
+	}
+	return rc, nil
+}
+
+//fileOrData reads a PEM from a file or from its base64 kubeconfig data
+func fileOrData(file, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
@@ -0,0 +1,145 @@
+package kube
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//writeFile writes a file of the test directory and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "ca.crt", "file CA")
+	writeFile(t, dir, "client.crt", "file cert")
+	writeFile(t, dir, "client.key", "file key")
+	inline := func(value string) string { return base64.StdEncoding.EncodeToString([]byte(value)) }
+	path := writeFile(t, dir, "config", `apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev-cluster
+  cluster:
+    server: https://dev.example.com:6443/
+    certificate-authority: ca.crt
+- name: prod-cluster
+  cluster:
+    server: https://prod.example.com
+    certificate-authority-data: `+inline("inline CA")+`
+- name: lab-cluster
+  cluster:
+    server: https://lab.example.com
+    insecure-skip-tls-verify: true
+contexts:
+- name: dev
+  context:
+    cluster: dev-cluster
+    user: cert-user
+    namespace: apps
+- name: prod
+  context:
+    cluster: prod-cluster
+    user: inline-user
+- name: gke
+  context:
+    cluster: lab-cluster
+    user: exec-user
+- name: broken
+  context:
+    cluster: missing-cluster
+    user: cert-user
+users:
+- name: cert-user
+  user:
+    client-certificate: client.crt
+    client-key: `+filepath.Join(dir, "client.key")+`
+- name: inline-user
+  user:
+    client-certificate-data: `+inline("inline cert")+`
+    client-key-data: `+inline("inline key")+`
+    token: static-token
+- name: exec-user
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: gke-gcloud-auth-plugin
+      args: ["--verbose"]
+      env:
+      - name: CLOUDSDK_CORE_PROJECT
+        value: lab
+`)
+
+	//the current context, with the files relative to the kubeconfig
+	rc, err := loadKubeconfig(path, "")
+	if err != nil {
+		t.Fatalf("current context: %v", err)
+	}
+	if rc.server != "https://dev.example.com:6443" || rc.namespace != "apps" {
+		t.Errorf("current context: server %q namespace %q", rc.server, rc.namespace)
+	}
+	if string(rc.caData) != "file CA" || string(rc.certData) != "file cert" || string(rc.keyData) != "file key" {
+		t.Errorf("current context: CA %q cert %q key %q, want the files", rc.caData, rc.certData, rc.keyData)
+	}
+
+	//inline data and token
+	rc, err = loadKubeconfig(path, "prod")
+	if err != nil {
+		t.Fatalf("prod context: %v", err)
+	}
+	if rc.server != "https://prod.example.com" || rc.namespace != "" || rc.token != "static-token" {
+		t.Errorf("prod context: server %q namespace %q token %q", rc.server, rc.namespace, rc.token)
+	}
+	if string(rc.caData) != "inline CA" || string(rc.certData) != "inline cert" || string(rc.keyData) != "inline key" {
+		t.Errorf("prod context: CA %q cert %q key %q, want the inline data", rc.caData, rc.certData, rc.keyData)
+	}
+
+	//credential plugin
+	rc, err = loadKubeconfig(path, "gke")
+	if err != nil {
+		t.Fatalf("gke context: %v", err)
+	}
+	if !rc.insecure || rc.exec == nil {
+		t.Fatalf("gke context: insecure %v exec %+v", rc.insecure, rc.exec)
+	}
+	if rc.exec.Command != "gke-gcloud-auth-plugin" || rc.exec.APIVersion != "client.authentication.k8s.io/v1beta1" ||
+		len(rc.exec.Args) != 1 || len(rc.exec.Env) != 1 || rc.exec.Env[0].Value != "lab" {
+		t.Errorf("gke context: exec %+v", rc.exec)
+	}
+
+	for _, context := range []string{"missing", "broken"} {
+		if _, err := loadKubeconfig(path, context); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("context %s: got %v, want a not found error", context, err)
+		}
+	}
+	if _, err := loadKubeconfig(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Errorf("missing kubeconfig loaded")
+	}
+}
+
+func TestKubeconfigPath(t *testing.T) {
+	if got := kubeconfigPath("/etc/kube/config"); got != "/etc/kube/config" {
+		t.Errorf("configured kubeconfig: got %s", got)
+	}
+	previous, set := os.LookupEnv("KUBECONFIG")
+	defer func() {
+		if set {
+			os.Setenv("KUBECONFIG", previous)
+		} else {
+			os.Unsetenv("KUBECONFIG")
+		}
+	}()
+	os.Setenv("KUBECONFIG", "/first/config"+string(filepath.ListSeparator)+"/second/config")
+	if got := kubeconfigPath(""); got != "/first/config" {
+		t.Errorf("KUBECONFIG: got %s, want the first file", got)
+	}
+}
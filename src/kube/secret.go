@@ -0,0 +1,85 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	mergePatch = "application/merge-patch+json"
+	//RestartedAtAnnotation is the pod template annotation kubectl rollout restart sets, changing it rolls the pods
+	RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+)
+
+//Secret is an Opaque Secret, Data is written as stringData
+type Secret struct {
+	Namespace   string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string]string
+}
+
+func (c *Client) namespace(namespace string) string {
+	if namespace == "" {
+		return c.rest.namespace
+	}
+	return namespace
+}
+
+//ApplySecret creates the Secret or updates its keys, labels and annotations, the keys it doesn't set are kept
+func (c *Client) ApplySecret(ctx context.Context, secret Secret) error {
+	namespace := c.namespace(secret.Namespace)
+	//a null field of a merge patch deletes it, only what is set is sent
+	metadata := map[string]interface{}{}
+	if secret.Labels != nil {
+		metadata["labels"] = secret.Labels
+	}
+	if secret.Annotations != nil {
+		metadata["annotations"] = secret.Annotations
+	}
+	patch := map[string]interface{}{"metadata": metadata, "stringData": secret.Data}
+	apiPath := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(namespace), url.PathEscape(secret.Name))
+	err := c.call(ctx, http.MethodPatch, apiPath, mergePatch, patch, nil)
+	if !IsNotFound(err) {
+		if err != nil {
+			return fmt.Errorf("update secret %s/%s: %v", namespace, secret.Name, err)
+		}
+		return nil
+	}
+
+	metadata["name"], metadata["namespace"] = secret.Name, namespace
+	object := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata":   metadata,
+		"stringData": secret.Data,
+	}
+	if err := c.call(ctx, http.MethodPost, fmt.Sprintf("/api/v1/namespaces/%s/secrets", url.PathEscape(namespace)), "application/json", object, nil); err != nil {
+		return fmt.Errorf("create secret %s/%s: %v", namespace, secret.Name, err)
+	}
+	return nil
+}
+
+//RestartDeployment rolls the pods of a Deployment the way kubectl rollout restart does
+func (c *Client) RestartDeployment(ctx context.Context, namespace, name string) error {
+	namespace = c.namespace(namespace)
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{RestartedAtAnnotation: time.Now().Format(time.RFC3339)},
+				},
+			},
+		},
+	}
+	apiPath := fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if err := c.call(ctx, http.MethodPatch, apiPath, mergePatch, patch, nil); err != nil {
+		return fmt.Errorf("restart deployment %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
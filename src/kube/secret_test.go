@@ -0,0 +1,348 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	configuration "mongo-util/config"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeRequest is a call received by the fake API server
+type fakeRequest struct {
+	method      string
+	path        string
+	contentType string
+	body        map[string]interface{}
+}
+
+//fakeAPIServer keeps the Secrets written to it and records every call
+type fakeAPIServer struct {
+	t     *testing.T
+	token string
+
+	mu       sync.Mutex
+	secrets  map[string]map[string]interface{}
+	requests []fakeRequest
+}
+
+func newFakeAPIServer(t *testing.T, token string) (*fakeAPIServer, *httptest.Server) {
+	fake := &fakeAPIServer{t: t, token: token, secrets: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeAPIServer) status(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "status": "Failure", "reason": reason, "message": message, "code": code})
+}
+
+//merge applies a JSON merge patch to an object
+func merge(object, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		child, isObject := value.(map[string]interface{})
+		current, hasObject := object[key].(map[string]interface{})
+		if isObject && hasObject {
+			merge(current, child)
+			continue
+		}
+		object[key] = value
+	}
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		f.status(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.status(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	f.requests = append(f.requests, fakeRequest{method: r.Method, path: r.URL.Path, contentType: r.Header.Get("Content-Type"), body: body})
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPatch && len(parts) == 6 && parts[4] == "secrets":
+		secret, ok := f.secrets[parts[3]+"/"+parts[5]]
+		if !ok {
+			f.status(w, http.StatusNotFound, "NotFound", fmt.Sprintf("secrets %q not found", parts[5]))
+			return
+		}
+		merge(secret, body)
+		json.NewEncoder(w).Encode(secret)
+	case r.Method == http.MethodPost && len(parts) == 5 && parts[4] == "secrets":
+		metadata, _ := body["metadata"].(map[string]interface{})
+		key := parts[3] + "/" + fmt.Sprint(metadata["name"])
+		if _, ok := f.secrets[key]; ok {
+			f.status(w, http.StatusConflict, "AlreadyExists", "already exists")
+			return
+		}
+		f.secrets[key] = body
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(body)
+	case r.Method == http.MethodPatch && len(parts) == 7 && parts[5] == "deployments":
+		json.NewEncoder(w).Encode(body)
+	default:
+		f.status(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+	}
+}
+
+//testClient is a client of the fake API server through a kubeconfig with a bearer token
+func testClient(t *testing.T, server, token, namespace string) *Client {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config", fmt.Sprintf(`current-context: test
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+    namespace: %s
+users:
+- name: test
+  user:
+    token: %s
+`, server, namespace, token))
+	client, err := NewClient(configuration.Kubernetes{Kubeconfig: path})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return client
+}
+
+func TestApplySecretCreatesMissingSecret(t *testing.T) {
+	fake, server := newFakeAPIServer(t, "token")
+	client := testClient(t, server.URL, "token", "apps")
+	ctx := context.Background()
+
+	secret := Secret{
+		Name:        "orders-db",
+		Labels:      map[string]string{"app.kubernetes.io/managed-by": "mongo-util"},
+		Annotations: map[string]string{"mongo-util.rotated-by": "jenkins"},
+		Data:        map[string]string{"username": "app", "password": "first"},
+	}
+	if err := client.ApplySecret(ctx, secret); err != nil {
+		t.Fatalf("ApplySecret of a missing Secret: %v", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Fatalf("ApplySecret of a missing Secret sent %d requests, want PATCH then POST", len(fake.requests))
+	}
+	patch, post := fake.requests[0], fake.requests[1]
+	if patch.method != http.MethodPatch || patch.path != "/api/v1/namespaces/apps/secrets/orders-db" || patch.contentType != mergePatch {
+		t.Errorf("first request is %s %s %s, want a merge patch of the Secret", patch.method, patch.path, patch.contentType)
+	}
+	if post.method != http.MethodPost || post.path != "/api/v1/namespaces/apps/secrets" {
+		t.Errorf("second request is %s %s, want a POST of the Secret", post.method, post.path)
+	}
+	created := fake.secrets["apps/orders-db"]
+	if created == nil {
+		t.Fatalf("the Secret was not created")
+	}
+	metadata := created["metadata"].(map[string]interface{})
+	if created["kind"] != "Secret" || created["type"] != "Opaque" || metadata["name"] != "orders-db" || metadata["namespace"] != "apps" {
+		t.Errorf("created %v", created)
+	}
+	if labels := metadata["labels"].(map[string]interface{}); labels["app.kubernetes.io/managed-by"] != "mongo-util" {
+		t.Errorf("created labels %v", labels)
+	}
+	if annotations := metadata["annotations"].(map[string]interface{}); annotations["mongo-util.rotated-by"] != "jenkins" {
+		t.Errorf("created annotations %v", annotations)
+	}
+	if data := created["stringData"].(map[string]interface{}); data["password"] != "first" || data["username"] != "app" {
+		t.Errorf("created stringData %v", data)
+	}
+
+	//an existing Secret is patched, the keys and labels not set are kept
+	fake.secrets["apps/orders-db"]["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["team"] = "dba"
+	update := Secret{Name: "orders-db", Data: map[string]string{"password": "second"}}
+	if err := client.ApplySecret(ctx, update); err != nil {
+		t.Fatalf("ApplySecret of an existing Secret: %v", err)
+	}
+	if len(fake.requests) != 3 || fake.requests[2].method != http.MethodPatch {
+		t.Fatalf("ApplySecret of an existing Secret sent %d requests, want a single PATCH", len(fake.requests)-2)
+	}
+	sent := fake.requests[2].body["metadata"].(map[string]interface{})
+	if _, ok := sent["labels"]; ok {
+		t.Errorf("a Secret without labels sent %v, a null would delete them", sent)
+	}
+	metadata = fake.secrets["apps/orders-db"]["metadata"].(map[string]interface{})
+	if labels := metadata["labels"].(map[string]interface{}); labels["team"] != "dba" || labels["app.kubernetes.io/managed-by"] != "mongo-util" {
+		t.Errorf("labels after the update %v", labels)
+	}
+	if data := fake.secrets["apps/orders-db"]["stringData"].(map[string]interface{}); data["password"] != "second" || data["username"] != "app" {
+		t.Errorf("stringData after the update %v", data)
+	}
+}
+
+func TestApplySecretErrors(t *testing.T) {
+	_, server := newFakeAPIServer(t, "token")
+	client := testClient(t, server.URL, "wrong", "apps")
+	err := client.ApplySecret(context.Background(), Secret{Name: "orders-db", Data: map[string]string{"password": "p"}})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("ApplySecret with a wrong token: got %v, want a 401", err)
+	}
+	if IsNotFound(err) {
+		t.Fatalf("a 401 is reported as not found")
+	}
+	if !IsNotFound(&Error{StatusCode: http.StatusNotFound}) {
+		t.Fatalf("a 404 is not reported as not found")
+	}
+}
+
+func TestRestartDeployment(t *testing.T) {
+	fake, server := newFakeAPIServer(t, "token")
+	client := testClient(t, server.URL, "token", "")
+	if client.Namespace() != DefaultNamespace {
+		t.Fatalf("a context without namespace uses %q, want %q", client.Namespace(), DefaultNamespace)
+	}
+	before := time.Now().Add(-time.Second)
+	if err := client.RestartDeployment(context.Background(), "shop", "orders"); err != nil {
+		t.Fatalf("RestartDeployment: %v", err)
+	}
+	if len(fake.requests) != 1 {
+		t.Fatalf("RestartDeployment sent %d requests", len(fake.requests))
+	}
+	request := fake.requests[0]
+	if request.method != http.MethodPatch || request.path != "/apis/apps/v1/namespaces/shop/deployments/orders" || request.contentType != mergePatch {
+		t.Fatalf("RestartDeployment sent %s %s %s", request.method, request.path, request.contentType)
+	}
+	annotations := request.body["spec"].(map[string]interface{})["template"].(map[string]interface{})["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	restartedAt, err := time.Parse(time.RFC3339, fmt.Sprint(annotations[RestartedAtAnnotation]))
+	if err != nil {
+		t.Fatalf("%s annotation: %v", RestartedAtAnnotation, err)
+	}
+	if restartedAt.Before(before) || restartedAt.After(time.Now()) {
+		t.Fatalf("%s is %s, want now", RestartedAtAnnotation, restartedAt)
+	}
+	if len(annotations) != 1 {
+		t.Fatalf("RestartDeployment patched the annotations %v", annotations)
+	}
+}
+
+func TestExecCredential(t *testing.T) {
+	fake, server := newFakeAPIServer(t, "exec-token")
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	plugin := writeFile(t, dir, "plugin.sh", `#!/bin/sh
+echo call >> "`+calls+`"
+case "$KUBERNETES_EXEC_INFO" in *ExecCredential*) ;; *) exit 1 ;; esac
+echo '{"apiVersion": "client.authentication.k8s.io/v1beta1", "kind": "ExecCredential",
+  "status": {"token": "'$PLUGIN_TOKEN'", "expirationTimestamp": "`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}}'
+`)
+	path := writeFile(t, dir, "config", fmt.Sprintf(`current-context: test
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+users:
+- name: test
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: /bin/sh
+      args: [%q]
+      env:
+      - name: PLUGIN_TOKEN
+        value: exec-token
+`, server.URL, plugin))
+	client, err := NewClient(configuration.Kubernetes{Kubeconfig: path})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := client.ApplySecret(ctx, Secret{Name: "orders-db", Data: map[string]string{"password": "p"}}); err != nil {
+			t.Fatalf("ApplySecret with the plugin token: %v", err)
+		}
+	}
+	if fake.secrets["default/orders-db"] == nil {
+		t.Fatalf("the Secret was not created")
+	}
+	data, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the token is reused until it expires
+	if n := strings.Count(string(data), "call"); n != 1 {
+		t.Fatalf("the plugin ran %d times, want once", n)
+	}
+}
+
+func TestClientTrustsTheKubeconfigCA(t *testing.T) {
+	fake := &fakeAPIServer{t: t, token: "token", secrets: map[string]map[string]interface{}{}}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	dir := t.TempDir()
+	writeFile(t, dir, "ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	path := writeFile(t, dir, "config", fmt.Sprintf(`current-context: test
+clusters:
+- name: test
+  cluster:
+    server: %s
+    certificate-authority: ca.crt
+- name: untrusted
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+- name: untrusted
+  context:
+    cluster: untrusted
+    user: test
+users:
+- name: test
+  user:
+    token: token
+`, server.URL, server.URL))
+
+	client, err := NewClient(configuration.Kubernetes{Kubeconfig: path})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := client.RestartDeployment(context.Background(), "", "orders"); err != nil {
+		t.Fatalf("RestartDeployment over TLS: %v", err)
+	}
+
+	untrusted, err := NewClient(configuration.Kubernetes{Kubeconfig: path, Context: "untrusted"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := untrusted.RestartDeployment(context.Background(), "", "orders"); err == nil {
+		t.Fatalf("a server signed by an unknown CA was trusted")
+	}
+
+	writeFile(t, dir, "ca.crt", "not a PEM")
+	if _, err := NewClient(configuration.Kubernetes{Kubeconfig: path}); err == nil {
+		t.Fatalf("NewClient accepted an invalid CA")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	kube "mongo-util/kube"
+	secrets "mongo-util/secrets"
+	"strings"
+)
+
+//kubernetesTarget is a Secret the credentials of a user are copied to
+type kubernetesTarget struct {
+	Namespace   string
+	Name        string
+	Deployments []string
+}
+
+//validKubernetes checks the apps of kubernetes in config.json
+func validKubernetes() error {
+	for i, app := range config.Kubernetes.Apps {
+		if app.Secret == "" || app.Username == "" {
+			return fmt.Errorf("kubernetes.apps[%d]: secret and username are required", i)
+		}
+	}
+	return nil
+}
+
+//openKubernetes connects to the cluster when kubernetes is enabled, nil otherwise
+func openKubernetes() (*kube.Client, error) {
+	if !config.Kubernetes.Enabled {
+		return nil, nil
+	}
+	client, err := kube.NewClient(config.Kubernetes)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	log.Printf("copying the rotated credentials to Kubernetes Secrets, default namespace %s", client.Namespace())
+	return client, nil
+}
+
+//kubernetesTargets are the Secrets of the apps the user is mapped to, or the Secret of the user if it has none
+func kubernetesTargets(user configuration.MongoUser) ([]kubernetesTarget, error) {
+	var targets []kubernetesTarget
+	for _, app := range config.Kubernetes.Apps {
+		if app.Username != user.Username || (app.Project != "" && app.Project != config.Mongo.ProjectName) ||
+			(app.Database != "" && app.Database != user.DBName) {
+			continue
+		}
+		targets = append(targets, kubernetesTarget{Namespace: app.Namespace, Name: app.Secret, Deployments: app.Deployments})
+	}
+	if len(targets) > 0 || config.Kubernetes.AppsOnly {
+		return targets, nil
+	}
+	secretID, err := secrets.SecretID(config, user)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.ReplaceAll(config.Kubernetes.SecretPrefix+secretID, "_", "-"))
+	return []kubernetesTarget{{Name: name}}, nil
+}
+
+//kubernetesData are the keys of the Secret of a user, read out of a secret saved in any format
+func kubernetesData(user configuration.MongoUser, payload string) map[string]string {
+	data := map[string]string{"username": user.Username, "auth_database": user.DBName}
+	var credential credentialPayload
+	if err := json.Unmarshal([]byte(payload), &credential); err == nil && credential.Username != "" {
+		for key, value := range map[string]string{"password": credential.Password, "certificate": credential.Certificate, "uri": credential.URI} {
+			if value != "" {
+				data[key] = value
+			}
+		}
+		return data
+	}
+	if user.IsAtlasManagedX509() {
+		data["certificate"] = payload
+	} else {
+		data["password"] = payload
+	}
+	return data
+}
+
+//publish copies the current secret of a rotated user to its Kubernetes Secrets and restarts the Deployments of its apps.
+//Atlas and the secret store already have the new credentials, a failure leaves the apps with the previous ones.
+func (r *rotator) publish(ctx context.Context, user configuration.MongoUser) error {
+	if r.kube == nil {
+		return nil
+	}
+	targets, err := kubernetesTargets(user)
+	if err != nil || len(targets) == 0 {
+		return err
+	}
+	//the store is read back so that the Secret holds exactly what was saved, whatever the format
+	_, payload, err := r.store.LatestSecret(ctx, user)
+	if err != nil {
+		return fmt.Errorf("read secret: %v", err)
+	}
+
+	labels := map[string]string{"app.kubernetes.io/managed-by": "mongo-util"}
+	for key, value := range config.Kubernetes.Labels {
+		labels[key] = value
+	}
+	var failures []string
+	for _, target := range targets {
+		secret := kube.Secret{
+			Namespace:   target.Namespace,
+			Name:        target.Name,
+			Labels:      labels,
+			Annotations: secrets.Annotations(config, &user),
+			Data:        kubernetesData(user, payload),
+		}
+		if err := r.kube.ApplySecret(ctx, secret); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		log.Printf("updated the Kubernetes Secret %s of %s", target.Name, user.Username)
+		for _, deployment := range target.Deployments {
+			if err := r.kube.RestartDeployment(ctx, target.Namespace, deployment); err != nil {
+				failures = append(failures, err.Error())
+				continue
+			}
+			log.Printf("restarted the Deployment %s to load the new credentials of %s", deployment, user.Username)
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	secrets "mongo-util/secrets"
+	"strings"
+)
+
+//listFileSecrets logs the secrets of the secret_store.file store with their versions, only the ones of the given
+//projects (comma separated) if projectNames is set. Payloads are not logged.
+func listFileSecrets(projectNames *string) error {
+	file, err := secrets.NewFile(config)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	projects := map[string]bool{}
+	if projectNames != nil {
+		for _, name := range strings.Split(*projectNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				projects[name] = true
+			}
+		}
+	}
+	count := 0
+	for _, secret := range file.Secrets() {
+		if len(projects) > 0 && !projects[secret.Annotations["mongo-util.project"]] {
+			continue
+		}
+		count++
+		log.Printf("%s project %s user %s rotated at %s by %s", secret.ID, secret.Annotations["mongo-util.project"],
+			secret.Annotations["mongo-util.username"], secret.Annotations["mongo-util.rotated-at"], secret.Annotations["mongo-util.rotated-by"])
+		for i := len(secret.Versions) - 1; i >= 0; i-- {
+			version := secret.Versions[i]
+			state := "disabled"
+			switch {
+			case version.Destroyed:
+				state = "destroyed"
+			case version.Enabled:
+				state = "enabled"
+			}
+			log.Printf("    version %d created %s %s", version.Number, version.Created.Format("2006-01-02 15:04:05"), state)
+		}
+	}
+	log.Printf("%d secrets in the secrets file", count)
+	return nil
+}
+
+//getFileSecret prints the payload of a version of a secret of the secret_store.file store, the current one if version is 0.
+//It goes to stdout alone so that it can be piped.
+func getFileSecret(secretID string, version int) error {
+	if secretID == "" {
+		return fmt.Errorf("%s argument is required", Secret)
+	}
+	file, err := secrets.NewFile(config)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	name, payload, err := file.Payload(secretID, version)
+	if err != nil {
+		return fmt.Errorf("secret %s: %v", secretID, err)
+	}
+	log.Printf("read %s", name)
+	fmt.Println(payload)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -32,29 +33,59 @@ func init() {
 }
 
 const (
-	Command          = "command"
-	GridFSReport     = "gridfs_report"
-	UpdatePasswords  = "update_passwords"
-	ClusterReport    = "cluster_report"
-	Execute          = "execute_query"
-	Help             = "help"
-	ProjectName      = "project_name"
-	Cluster          = "cluster"
-	Database         = "db"
-	Collection       = "collection"
-	AtlasPubKey      = "atlas_pub_key"
-	AtlasPrivateKey  = "atlas_private_key"
-	DataApiKey       = "data_api_key"
-	ConnectionString = "connection_string"
-	Query            = "query"
+	Command           = "command"
+	GridFSReport      = "gridfs_report"
+	UpdatePasswords   = "update_passwords"
+	RotateAPIKeys     = "rotate_api_keys"
+	PruneSecrets      = "prune_secrets"
+	ReconcileSecrets  = "reconcile_secrets"
+	SecretsList       = "secrets_list"
+	SecretsGet        = "secrets_get"
+	IssueCredentials  = "issue_credentials"
+	ListCredentials   = "list_credentials"
+	RevokeCredentials = "revoke_credentials"
+	ClusterReport     = "cluster_report"
+	Execute           = "execute_query"
+	Help              = "help"
+	ProjectName       = "project_name"
+	OrgID             = "org_id"
+	Cluster           = "cluster"
+	Database          = "db"
+	Collection        = "collection"
+	AtlasPubKey       = "atlas_pub_key"
+	AtlasPrivateKey   = "atlas_private_key"
+	DataApiKey        = "data_api_key"
+	ConnectionString  = "connection_string"
+	Query             = "query"
+	DryRun            = "dry_run"
+	IncludeUsers      = "include_users"
+	ExcludeUsers      = "exclude_users"
+	IncludeDatabases  = "include_dbs"
+	ExcludeDatabases  = "exclude_dbs"
+	IncludeRoles      = "include_roles"
+	ExcludeRoles      = "exclude_roles"
+	IncludeScopes     = "include_scopes"
+	ExcludeScopes     = "exclude_scopes"
+	Workers           = "workers"
+	ReportFormat      = "report_format"
+	MaxAge            = "max_age"
+	Verify            = "verify"
+	IssueX509Certs    = "issue_x509_certs"
+	Username          = "username"
+	Roles             = "roles"
+	TTL               = "ttl"
+	Resume            = "resume"
+	Secret            = "secret"
+	SecretVersion     = "version"
 )
 
 func main() {
 
 	//command line arguments
 	command := flag.String(Command, ClusterReport, "Operation name") //Default command is genreate-clusterdetails
-	projectName := flag.String(ProjectName, "", "project name")
-	clusterName := flag.String(Cluster, "", "database name")
+	projectName := flag.String(ProjectName, "", "project name, update_passwords accepts a comma separated list")
+	orgID := flag.String(OrgID, "", "organization id, update_passwords rotates all of its projects")
+	clusterName := flag.String(Cluster, "", "cluster name, issue_credentials accepts a comma separated list")
 	dbName := flag.String(Database, "", "database name")
 	collName := flag.String(Collection, "", "collection name")
 	pubKey := flag.String(AtlasPubKey, "", "atlas public key")
@@ -62,6 +93,29 @@ func main() {
 	dataApiKey := flag.String(DataApiKey, "", "data api key")
 	connString := flag.String(ConnectionString, "", "Mongodb connection string")
 	query := flag.String(Query, "", "query to execute")
+	secretID := flag.String(Secret, "", "secret id read by secrets_get")
+	secretVersion := flag.Int(SecretVersion, 0, "version read by secrets_get (default the current one)")
+	var rotation rotationOptions
+	flag.BoolVar(&rotation.DryRun, DryRun, false, "list the planned changes without applying them")
+	flag.IntVar(&rotation.Workers, Workers, 0, "number of users rotated concurrently (default rotation.workers of config.json or 4)")
+	flag.StringVar(&rotation.ReportFormat, ReportFormat, ReportCSV, "format of the rotation report: csv or json")
+	flag.StringVar(&rotation.MaxAge, MaxAge, "", "rotate only the users whose secret is older than this age eg: 30d, 12h")
+	flag.BoolVar(&rotation.Verify, Verify, false, "authenticate with every new password on the user's clusters before it is made current")
+	flag.BoolVar(&rotation.Resume, Resume, false, "skip the users rotated by the interrupted run recorded in "+CheckpointFile)
+	var credentials credentialsRequest
+	flag.StringVar(&credentials.Username, Username, "", "username of the temporary user (default tmp-<random>)")
+	flag.StringVar(&credentials.Roles, Roles, "", "roles of the temporary user as roleName@databaseName, comma separated")
+	flag.StringVar(&credentials.TTL, TTL, DefaultCredentialsTTL, "lifetime of the temporary user eg: 1h, 2d (at most 7d)")
+	flag.BoolVar(&rotation.IssueX509Certs, IssueX509Certs, false, "issue a new certificate for the Atlas-managed X.509 users and save it as their secret")
+	filter := &rotation.Filter
+	flag.StringVar(&filter.IncludeUsers, IncludeUsers, "", "regex, rotate only the matching usernames")
+	flag.StringVar(&filter.ExcludeUsers, ExcludeUsers, "", "regex, don't rotate the matching usernames")
+	flag.StringVar(&filter.IncludeDatabases, IncludeDatabases, "", "regex, rotate only the users of the matching auth databases")
+	flag.StringVar(&filter.ExcludeDatabases, ExcludeDatabases, "", "regex, don't rotate the users of the matching auth databases")
+	flag.StringVar(&filter.IncludeRoles, IncludeRoles, "", "regex on roleName@databaseName, rotate only the users holding a matching role")
+	flag.StringVar(&filter.ExcludeRoles, ExcludeRoles, "", "regex on roleName@databaseName, don't rotate the users holding a matching role")
+	flag.StringVar(&filter.IncludeScopes, IncludeScopes, "", "regex, rotate only the users scoped to a matching cluster")
+	flag.StringVar(&filter.ExcludeScopes, ExcludeScopes, "", "regex, don't rotate the users scoped to a matching cluster")
 
 	flag.Parse()
 
@@ -78,7 +132,59 @@ func main() {
 			log.Println(err)
 			return
 		}
-		if err := updatePasswords(projectName); err != nil {
+		if err := updatePasswords(projectName, orgID, rotation); err != nil {
+			log.Println(err)
+			return
+		}
+	case RotateAPIKeys:
+		if err := setAtlasConfig(pubKey, privateKey); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := rotateAPIKeys(projectName, rotation.DryRun); err != nil {
+			log.Println(err)
+			return
+		}
+	case PruneSecrets:
+		//only secret manager is used, no Atlas key is needed
+		if err := pruneSecrets(projectName, rotation.DryRun); err != nil {
+			log.Println(err)
+			return
+		}
+	case ReconcileSecrets:
+		//only secret manager is used, no Atlas key is needed
+		if err := reconcileSecrets(projectName, rotation.DryRun); err != nil {
+			log.Println(err)
+			return
+		}
+	case SecretsList, SecretsGet:
+		//only the local secrets file is read, no Atlas key is needed
+		var err error
+		if *command == SecretsList {
+			err = listFileSecrets(projectName)
+		} else {
+			err = getFileSecret(*secretID, *secretVersion)
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	case IssueCredentials, ListCredentials, RevokeCredentials:
+		if err := setAtlasConfig(pubKey, privateKey); err != nil {
+			log.Println(err)
+			return
+		}
+		var err error
+		switch *command {
+		case IssueCredentials:
+			credentials.Clusters = *clusterName
+			err = issueCredentials(projectName, credentials)
+		case ListCredentials:
+			err = listCredentials(projectName)
+		case RevokeCredentials:
+			err = revokeCredentials(projectName, credentials.Username)
+		}
+		if err != nil {
 			log.Println(err)
 			return
 		}
@@ -118,29 +224,56 @@ func main() {
 	return
 }
 
+//setAtlasConfig takes the Atlas API key from the flags, else from config.json, either can be a secret reference
 func setAtlasConfig(pubKey, privateKey *string) error {
+	warnPlainFlag(AtlasPrivateKey, *privateKey)
+	if *pubKey != "" {
+		config.Mongo.PublicKey = *pubKey
+	}
+	if *privateKey != "" {
+		config.Mongo.PrivateKey = *privateKey
+	}
 
-	if *pubKey == "" || *privateKey == "" {
+	ctx := context.Background()
+	var err error
+	if config.Mongo.PublicKey, err = resolveSecretRef(ctx, AtlasPubKey, config.Mongo.PublicKey); err != nil {
+		return err
+	}
+	if config.Mongo.PrivateKey, err = resolveSecretRef(ctx, AtlasPrivateKey, config.Mongo.PrivateKey); err != nil {
+		return err
+	}
+	if config.Mongo.PublicKey == "" || config.Mongo.PrivateKey == "" {
 		return errors.New(fmt.Sprintf("%s or %s is missing, please check", AtlasPubKey, AtlasPrivateKey))
 	}
-	config.Mongo.PublicKey = *pubKey
-	config.Mongo.PrivateKey = *privateKey
 	return nil
 }
 
 func setAggregationConfig(clusterName, dbName, collName, dataApiKey, connString *string) error {
 
 	if connString != nil && *connString != "" {
+		warnPlainFlag(ConnectionString, *connString)
 		config.Mongo.ConnectionString = connString
 	}
 	if config.Mongo.ConnectionString == nil || *config.Mongo.ConnectionString == "" {
 		return errors.New(fmt.Sprintf("connection string is requried"))
 	}
 
-	if dataApiKey != nil {
+	if dataApiKey != nil && *dataApiKey != "" {
+		warnPlainFlag(DataApiKey, *dataApiKey)
 		config.Mongo.ApiKey = *dataApiKey
 	}
 
+	//the connection string and the data api key can be secret references, in config.json or in the flags
+	ctx := context.Background()
+	resolved, err := resolveSecretRef(ctx, ConnectionString, *config.Mongo.ConnectionString)
+	if err != nil {
+		return err
+	}
+	config.Mongo.ConnectionString = &resolved
+	if config.Mongo.ApiKey, err = resolveSecretRef(ctx, DataApiKey, config.Mongo.ApiKey); err != nil {
+		return err
+	}
+
 	//Validation for query params
 	if clusterName == nil || *clusterName == "" {
 		return errors.New(fmt.Sprintf("invalid request: %s parameter required to generate GridFS report", Cluster))
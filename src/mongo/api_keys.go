@@ -0,0 +1,78 @@
+package mongo
+
+import (
+	"fmt"
+	configuration "mongo-util/config"
+	"net/http"
+)
+
+//GetAPIKeys lists the programmatic API keys of an organization
+func GetAPIKeys(orgID string, config configuration.Mongo) ([]configuration.APIKey, error) {
+	url := fmt.Sprintf("%s/orgs/%s/apiKeys?itemsPerPage=500", config.AtlasEndPoint, orgID)
+
+	var keys configuration.APIKeys
+	if err := callAtlas(http.MethodGet, url, nil, &keys, config); err != nil {
+		return nil, err
+	}
+	return keys.Keys, nil
+}
+
+//GetAPIKeyAccessList lists the IP addresses and CIDR blocks an API key can be used from
+func GetAPIKeyAccessList(orgID, keyID string, config configuration.Mongo) ([]configuration.AccessListEntry, error) {
+	url := fmt.Sprintf("%s/orgs/%s/apiKeys/%s/accessList?itemsPerPage=500", config.AtlasEndPoint, orgID, keyID)
+
+	var accessList configuration.AccessList
+	if err := callAtlas(http.MethodGet, url, nil, &accessList, config); err != nil {
+		return nil, err
+	}
+	return accessList.Entries, nil
+}
+
+//CreateAPIKey creates an organization API key with the given organization roles,
+//the returned key is the only place its private key can be read from
+func CreateAPIKey(orgID, desc string, roles []string, config configuration.Mongo) (*configuration.APIKey, error) {
+	url := fmt.Sprintf("%s/orgs/%s/apiKeys", config.AtlasEndPoint, orgID)
+
+	var key configuration.APIKey
+	payload := map[string]interface{}{
+		"desc":  desc,
+		"roles": roles,
+	}
+	if err := callAtlas(http.MethodPost, url, payload, &key, config); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+//AddAPIKeyAccessList allows an API key to be used from the given IP addresses and CIDR blocks
+func AddAPIKeyAccessList(orgID, keyID string, entries []configuration.AccessListEntry, config configuration.Mongo) error {
+	url := fmt.Sprintf("%s/orgs/%s/apiKeys/%s/accessList", config.AtlasEndPoint, orgID, keyID)
+
+	//Atlas lists single addresses with both fields, only one of them can be sent back
+	var payload []configuration.AccessListEntry
+	for _, entry := range entries {
+		if entry.CIDRBlock != "" {
+			payload = append(payload, configuration.AccessListEntry{CIDRBlock: entry.CIDRBlock})
+			continue
+		}
+		payload = append(payload, configuration.AccessListEntry{IPAddress: entry.IPAddress})
+	}
+	return callAtlas(http.MethodPost, url, payload, nil, config)
+}
+
+//AssignAPIKeyToProject grants project roles to an organization API key
+func AssignAPIKeyToProject(groupID, keyID string, roles []string, config configuration.Mongo) error {
+	url := fmt.Sprintf("%s/groups/%s/apiKeys/%s", config.AtlasEndPoint, groupID, keyID)
+
+	payload := map[string]interface{}{
+		"roles": roles,
+	}
+	return callAtlas(http.MethodPatch, url, payload, nil, config)
+}
+
+//DeleteAPIKey deletes an organization API key, it is removed from all the projects too
+func DeleteAPIKey(orgID, keyID string, config configuration.Mongo) error {
+	url := fmt.Sprintf("%s/orgs/%s/apiKeys/%s", config.AtlasEndPoint, orgID, keyID)
+
+	return callAtlas(http.MethodDelete, url, nil, nil, config)
+}
@@ -10,34 +10,54 @@ import (
 	"net/http"
 )
 
-func GetUsersByProject(config configuration.Mongo) ([]configuration.MongoUser, error) {
-	url := fmt.Sprintf("%s/groups/%s/databaseUsers", config.AtlasEndPoint, config.ProjectID)
-
-	var data configuration.UserData
-	//Make GET Call
-	resp, err := configuration.HttpCall("GET", url, []byte(""), config)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+//GetProjectsByOrg lists the projects of an organization
+func GetProjectsByOrg(orgID string, config configuration.Mongo) ([]configuration.Project, error) {
+	var projects []configuration.Project
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/orgs/%s/groups?itemsPerPage=500&pageNum=%d", config.AtlasEndPoint, orgID, page)
+
+		var data configuration.ProjectData
+		if err := callAtlas(http.MethodGet, url, nil, &data, config); err != nil {
+			return nil, err
+		}
+		projects = append(projects, data.Projects...)
+		if len(data.Projects) == 0 || len(projects) >= data.TotalCount {
+			return projects, nil
+		}
 	}
-	if resp.StatusCode == http.StatusOK {
-		//log.Println(string(body))
-		err = json.Unmarshal(body, &data)
+}
+
+//AtlasError is returned when Atlas answers a call with an unexpected status code
+type AtlasError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *AtlasError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Body)
+}
+
+//GetUsersByProject lists the db users of a project, page by page as Atlas returns 100 of them by default
+func GetUsersByProject(config configuration.Mongo) ([]configuration.MongoUser, error) {
+	var users []configuration.MongoUser
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/groups/%s/databaseUsers?itemsPerPage=500&pageNum=%d", config.AtlasEndPoint, config.ProjectID, page)
+
+		var data configuration.UserData
+		err := callAtlas(http.MethodGet, url, nil, &data, config)
+		var atlasErr *AtlasError
+		if errors.As(err, &atlasErr) && atlasErr.StatusCode == http.StatusForbidden {
+			return nil, errors.New("forbidden error, suggestion: check whether this machine IP is allowed to access the MongoCLuster")
+		}
 		if err != nil {
+			log.Println("Mongo get users API Error:", err)
 			return nil, err
 		}
-	} else {
-		if resp.StatusCode == http.StatusForbidden {
-			err = errors.New("forbidden error, suggestion: check whether this machine IP is allowed to access the MongoCLuster")
-			return nil, err
+		users = append(users, data.Users...)
+		if len(data.Users) == 0 || len(users) >= data.TotalCount {
+			return users, nil
 		}
-		log.Fatalln("Mongo get users API Error:", string(body))
 	}
-	return data.Users, err
 }
 
 func GetProjectByProjectName(config configuration.Mongo) (*configuration.Project, error) {
@@ -47,7 +67,7 @@ func GetProjectByProjectName(config configuration.Mongo) (*configuration.Project
 	//Make GET Call
 	resp, err := configuration.HttpCall("GET", url, []byte(""), config)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
@@ -65,27 +85,60 @@ func GetProjectByProjectName(config configuration.Mongo) (*configuration.Project
 			err = errors.New("forbidden error, suggestion: check whether this machine IP is allowed to access the MongoCLuster")
 			return nil, err
 		}
-		log.Fatalln("Mongo get Project Details by name API Error:", string(body))
+		log.Println("Mongo get Project Details by name API Error:", string(body))
+		return nil, &AtlasError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	return &project, err
 }
 
+//callAtlas makes an Atlas API call and decodes the JSON response into out, if not nil
+func callAtlas(method, url string, payload interface{}, out interface{}, config configuration.Mongo) error {
+	data := []byte("")
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	resp, err := configuration.HttpCall(method, url, data, config)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return &AtlasError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+//UserURL is the Atlas API resource of a given db user, UpdatePassword PATCHes this url
+func UserURL(user configuration.MongoUser, config configuration.Mongo) string {
+	return fmt.Sprintf("%s/groups/%s/databaseUsers/%s/%s", config.AtlasEndPoint, config.ProjectID, user.DBName, user.Username)
+}
+
 //UpdatePassword is for updating db user password with random string
 func UpdatePassword(pwd string, user configuration.MongoUser, config configuration.Mongo) error {
-	url := fmt.Sprintf("%s/groups/%s/databaseUsers/%s/%s", config.AtlasEndPoint, config.ProjectID, user.DBName, user.Username)
+	url := UserURL(user, config)
 
 	//Generating payload for Atlas UpdateUser API
 	data, err := json.Marshal(map[string]interface{}{
 		"password": pwd,
 	})
 	if err != nil {
-		log.Fatal("marshall error:", err)
+		return err
 	}
 
 	//Make PATCH Call
 	resp, err := configuration.HttpCall(http.MethodPatch, url, data, config)
 	if err != nil {
-		log.Fatalln("error:", err)
 		return err
 	}
 
@@ -99,12 +152,72 @@ func UpdatePassword(pwd string, user configuration.MongoUser, config configurati
 		}
 		log.Println(string(body))
 		//Return the status code rather error stack
-		return errors.New(string(resp.StatusCode))
+		return &AtlasError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	return err
 }
 
+//CreateUser creates a db user with the given password, roles, scopes, labels and deleteAfterDate of user
+func CreateUser(user configuration.MongoUser, pwd string, config configuration.Mongo) error {
+	url := fmt.Sprintf("%s/groups/%s/databaseUsers", config.AtlasEndPoint, config.ProjectID)
+
+	payload := map[string]interface{}{
+		"groupId":      config.ProjectID,
+		"databaseName": user.DBName,
+		"username":     user.Username,
+		"password":     pwd,
+		"roles":        user.Roles,
+	}
+	if len(user.Scopes) > 0 {
+		payload["scopes"] = user.Scopes
+	}
+	if len(user.Labels) > 0 {
+		payload["labels"] = user.Labels
+	}
+	if user.DeleteAfterDate != "" {
+		payload["deleteAfterDate"] = user.DeleteAfterDate
+	}
+	return callAtlas(http.MethodPost, url, payload, nil, config)
+}
+
+//DeleteUser deletes a db user
+func DeleteUser(user configuration.MongoUser, config configuration.Mongo) error {
+	return callAtlas(http.MethodDelete, UserURL(user, config), nil, nil, config)
+}
+
+//CertificateURL is the Atlas API resource issuing X.509 certificates for a db user
+func CertificateURL(user configuration.MongoUser, config configuration.Mongo) string {
+	return fmt.Sprintf("%s/groups/%s/databaseUsers/%s/certs", config.AtlasEndPoint, config.ProjectID, user.Username)
+}
+
+//IssueCertificate generates an Atlas-managed X.509 certificate for a db user and returns it in PEM format
+func IssueCertificate(user configuration.MongoUser, months int, config configuration.Mongo) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"monthsUntilExpiration": months,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	//Make POST Call
+	resp, err := configuration.HttpCall(http.MethodPost, CertificateURL(user, config), data, config)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", &AtlasError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	//the certificate and its private key come back as a PEM file
+	return string(body), nil
+}
+
 func GetClusterInfo(config configuration.Mongo) (*configuration.ClusterInfo, error) {
 	url := fmt.Sprintf("%s/groups/%s/clusters", config.AtlasEndPoint, config.ProjectID)
 
@@ -114,7 +227,6 @@ func GetClusterInfo(config configuration.Mongo) (*configuration.ClusterInfo, err
 	//Make GET Call
 	resp, err := configuration.HttpCall(http.MethodGet, url, data, config)
 	if err != nil {
-		log.Fatalln("error:", err)
 		return nil, err
 	}
 
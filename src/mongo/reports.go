@@ -2,6 +2,7 @@ package mongo
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"os"
 )
 
@@ -20,3 +21,17 @@ func GenerateCSV(entries [][]string, fileName string) error {
 	}
 	return err
 }
+
+//GenerateJSON writes the entries as an indented JSON document
+func GenerateJSON(entries interface{}, fileName string) error {
+
+	jsonFile, err := os.Create(fileName + ".json")
+	if err != nil {
+		return err
+	}
+	defer jsonFile.Close()
+
+	encoder := json.NewEncoder(jsonFile)
+	encoder.SetIndent("", "	")
+	return encoder.Encode(entries)
+}
@@ -0,0 +1,31 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+//VerifyCredentials authenticates against a cluster with the given credentials and runs ping
+func VerifyCredentials(uri, username, password, authSource string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	credential := options.Credential{
+		AuthSource: authSource,
+		Username:   username,
+		Password:   password,
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetAuth(credential))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	//ping the nearest member, any member checks the credentials
+	return client.Ping(ctx, readpref.Nearest())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	configuration "mongo-util/config"
+	"net/url"
+	"time"
+)
+
+//Secret formats of gcp.secret_format
+const (
+	SecretFormatPassword = "password"
+	SecretFormatJSON     = "json"
+)
+
+//credentialPayload is the secret of a db user with gcp.secret_format json
+type credentialPayload struct {
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	Certificate  string `json:"certificate,omitempty"`
+	AuthDatabase string `json:"auth_database"`
+	ProjectID    string `json:"project_id"`
+	ProjectName  string `json:"project_name"`
+	//URI is the connection string of the first cluster, the one to use for single cluster projects
+	URI       string              `json:"uri,omitempty"`
+	Clusters  []clusterConnection `json:"clusters,omitempty"`
+	RotatedAt string              `json:"rotated_at"`
+}
+
+//clusterConnection is a cluster the user can connect to
+type clusterConnection struct {
+	Name        string `json:"name"`
+	StandardSrv string `json:"standard_srv"`
+	URI         string `json:"uri"`
+}
+
+//validSecretFormat checks gcp.secret_format
+func validSecretFormat() error {
+	switch config.GCP.SecretFormat {
+	case "", SecretFormatPassword, SecretFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid gcp.secret_format %q, expected %s or %s", config.GCP.SecretFormat, SecretFormatPassword, SecretFormatJSON)
+}
+
+//jsonSecrets tells if the secrets hold a credentialPayload
+func jsonSecrets() bool {
+	return config.GCP.SecretFormat == SecretFormatJSON
+}
+
+//secretPayload is what is saved as the secret of a user: the password or the certificate as is,
+//or a credentialPayload with the connection strings of the given clusters the user can access
+func secretPayload(user configuration.MongoUser, password, certificate string, clusters []configuration.Cluster) (string, error) {
+	if !jsonSecrets() {
+		if certificate != "" {
+			return certificate, nil
+		}
+		return password, nil
+	}
+
+	payload := credentialPayload{
+		Username:     user.Username,
+		Password:     password,
+		Certificate:  certificate,
+		AuthDatabase: user.DBName,
+		ProjectID:    user.ProjectID,
+		ProjectName:  config.Mongo.ProjectName,
+		RotatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, cluster := range clusters {
+		if !inScope(user, cluster) || cluster.ConnectionStrings.StandardSrv == "" {
+			continue
+		}
+		uri, err := connectionURI(cluster.ConnectionStrings.StandardSrv, user, password)
+		if err != nil {
+			return "", fmt.Errorf("connection string of cluster %s: %v", cluster.Name, err)
+		}
+		payload.Clusters = append(payload.Clusters, clusterConnection{
+			Name:        cluster.Name,
+			StandardSrv: cluster.ConnectionStrings.StandardSrv,
+			URI:         uri,
+		})
+	}
+	if len(payload.Clusters) > 0 {
+		payload.URI = payload.Clusters[0].URI
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+//connectionURI adds the credentials and the auth database of a user to a cluster SRV connection string,
+//certificate users authenticate with MONGODB-X509 and have no password in the URI
+func connectionURI(srv string, user configuration.MongoUser, password string) (string, error) {
+	uri, err := url.Parse(srv)
+	if err != nil {
+		return "", err
+	}
+	query := uri.Query()
+	if password != "" {
+		uri.User = url.UserPassword(user.Username, password)
+		query.Set("authSource", user.DBName)
+	} else {
+		query.Set("authSource", "$external")
+		query.Set("authMechanism", "MONGODB-X509")
+	}
+	uri.Path = "/"
+	uri.RawQuery = query.Encode()
+	return uri.String(), nil
+}
+
+//secretPassword reads the password out of a secret saved in any format, the format may have changed
+//since the secret was saved
+func secretPassword(secret string) string {
+	var payload credentialPayload
+	if err := json.Unmarshal([]byte(secret), &payload); err == nil && payload.Password != "" {
+		return payload.Password
+	}
+	return secret
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	gcp "mongo-util/gcp"
+	secrets "mongo-util/secrets"
+	"strings"
+	"time"
+)
+
+//pruned is the past tense of a prune action for the logs
+func pruned(action string) string {
+	if action == secrets.PruneDestroy {
+		return "destroyed"
+	}
+	return "disabled"
+}
+
+//managedProjects are the projects of -project_name (comma separated) whose secrets are managed,
+//"" stands for all the secrets labelled by this tool
+func managedProjects(projectNames *string) []string {
+	if projectNames == nil || *projectNames == "" {
+		return []string{""}
+	}
+	var projects []string
+	for _, name := range strings.Split(*projectNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			projects = append(projects, name)
+		}
+	}
+	return projects
+}
+
+//pruneSecrets applies gcp.retention to the secrets saved by this tool, only the ones of the given
+//projects (comma separated) if projectNames is set. With dryRun the versions are listed but not changed.
+func pruneSecrets(projectNames *string, dryRun bool) error {
+	if config.SecretStore.Type != "" && config.SecretStore.Type != configuration.StoreGCP {
+		return fmt.Errorf("prune_secrets prunes GCP secret manager only, secret_store.type is %s", config.SecretStore.Type)
+	}
+	retention := config.GCP.Retention
+	if err := retention.Validate(); err != nil {
+		return err
+	}
+	if !retention.Enabled() {
+		return fmt.Errorf("gcp.retention is not set in config.json, nothing to prune")
+	}
+
+	projects := managedProjects(projectNames)
+	ctx := context.Background()
+	client, err := gcp.NewClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	secretCount, disabled, destroyed, failures := 0, 0, 0, 0
+	for _, project := range projects {
+		names, err := client.ManagedSecrets(ctx, project)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			secretCount++
+			actions, err := client.PruneSecret(ctx, name, retention, dryRun)
+			if err != nil {
+				log.Printf("unable to prune %s: %v", name, err)
+				failures++
+			}
+			for _, action := range actions {
+				if action.Action == secrets.PruneDestroy {
+					destroyed++
+				} else {
+					disabled++
+				}
+				if dryRun {
+					log.Printf("DRY RUN: would %s %s, created %s", action.Action, action.Version, action.Created.Format(time.RFC3339))
+					continue
+				}
+				log.Printf("%s %s, created %s", pruned(action.Action), action.Version, action.Created.Format(time.RFC3339))
+			}
+		}
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "DRY RUN: would have "
+	}
+	log.Printf("%s%d versions disabled and %d destroyed across %d secrets", prefix, disabled, destroyed, secretCount)
+	if failures > 0 {
+		return fmt.Errorf("%d secrets could not be pruned", failures)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	gcp "mongo-util/gcp"
+)
+
+//reconcileSecrets applies the replication, ttl, topics and rotation_period of gcp to the existing secrets saved by
+//this tool, only the ones of the given projects (comma separated) if projectNames is set. With dryRun the differences
+//are listed but nothing is changed.
+func reconcileSecrets(projectNames *string, dryRun bool) error {
+	if config.SecretStore.Type != "" && config.SecretStore.Type != configuration.StoreGCP {
+		return fmt.Errorf("reconcile_secrets reconciles GCP secret manager only, secret_store.type is %s", config.SecretStore.Type)
+	}
+	if err := config.GCP.ValidateSecretSettings(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, err := gcp.NewClient(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	secretCount, fixed, unfixable, failures := 0, 0, 0, 0
+	for _, project := range managedProjects(projectNames) {
+		names, err := client.ManagedSecrets(ctx, project)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			secretCount++
+			changes, err := client.ReconcileSecret(ctx, name, dryRun)
+			if err != nil {
+				log.Printf("unable to reconcile %s: %v", name, err)
+				failures++
+			}
+			for _, change := range changes {
+				switch {
+				case !change.Fixable:
+					unfixable++
+					log.Printf("WARNING: %s of %s is %q instead of %q and can't change, recreate the secret to fix it",
+						change.Setting, name, change.Current, change.Wanted)
+				case dryRun:
+					fixed++
+					log.Printf("DRY RUN: would change %s of %s from %q to %q", change.Setting, name, change.Current, change.Wanted)
+				case err == nil:
+					fixed++
+					log.Printf("changed %s of %s from %q to %q", change.Setting, name, change.Current, change.Wanted)
+				}
+			}
+		}
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "DRY RUN: would have "
+	}
+	log.Printf("%sfixed %d settings across %d secrets, %d can't be fixed", prefix, fixed, secretCount, unfixable)
+	if failures > 0 {
+		return fmt.Errorf("%d secrets could not be reconciled", failures)
+	}
+	return nil
+}
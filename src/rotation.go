@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	kube "mongo-util/kube"
+	mongo "mongo-util/mongo"
+	secrets "mongo-util/secrets"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//RecoveryFile collects the records of the rotations which could not be completed nor rolled back cleanly
+const RecoveryFile = "rotation_recovery.jsonl"
+
+//recoveryRecord tells what was left behind by a failed rotation and how to recover from it
+type recoveryRecord struct {
+	Time          string `json:"time"`
+	ProjectID     string `json:"project_id"`
+	Username      string `json:"username"`
+	DBName        string `json:"database"`
+	Step          string `json:"step"`
+	StagedVersion string `json:"staged_version,omitempty"`
+	Error         string `json:"error"`
+	Recovery      string `json:"recovery"`
+}
+
+//DefaultWorkers is the number of users rotated concurrently when neither the flag nor config.json sets it
+const DefaultWorkers = 4
+
+//rotationOptions are the update_passwords settings coming from the command line
+type rotationOptions struct {
+	Filter         configuration.UserFilter
+	DryRun         bool
+	Workers        int
+	ReportFormat   string
+	MaxAge         string
+	Verify         bool
+	IssueX509Certs bool
+	Resume         bool
+}
+
+//maxAge parses -max_age, 0 means every selected user is rotated whatever the age of its secret
+func (o rotationOptions) maxAge() (time.Duration, error) {
+	if o.MaxAge == "" {
+		return 0, nil
+	}
+	age, err := configuration.ParseAge(o.MaxAge)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", MaxAge, err)
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, it must be positive", MaxAge, o.MaxAge)
+	}
+	return age, nil
+}
+
+//secretAge is the age of the current secret of a user, found is false if the user has no secret yet
+func secretAge(ctx context.Context, store secrets.Store, user configuration.MongoUser) (age time.Duration, found bool, err error) {
+	created, err := secrets.LatestVersionTime(ctx, store, user)
+	if err == secrets.ErrNoSecretVersion {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Since(created), true, nil
+}
+
+//formatAge prints an age in days, the unit of -max_age
+func formatAge(age time.Duration, found bool) string {
+	if !found {
+		return "no secret"
+	}
+	return fmt.Sprintf("%.1fd", age.Hours()/24)
+}
+
+//workers resolves the size of the worker pool: flag, then config.json, then DefaultWorkers
+func (o rotationOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	if config.Rotation.Workers > 0 {
+		return config.Rotation.Workers
+	}
+	return DefaultWorkers
+}
+
+//rotator holds what the workers share while rotating the users of a project
+type rotator struct {
+	store  secrets.Store
+	maxAge time.Duration
+	//clusters the new passwords are verified against, verification is disabled if nil
+	clusters []configuration.Cluster
+	verify   configuration.Verify
+	//connections are the clusters whose connection strings are saved in the json secrets
+	connections []configuration.Cluster
+	//issueCerts rotates Atlas-managed X.509 users by issuing them a new certificate
+	issueCerts bool
+	//kube receives a copy of the rotated credentials, nil if kubernetes is not enabled
+	kube *kube.Client
+}
+
+//DefaultCertificateMonths is the validity of the issued X.509 certificates when config.json doesn't set it
+const DefaultCertificateMonths = 3
+
+//rotateUser generates a password compliant with the policy and rotates it,
+//with maxAge set users whose secret is younger than maxAge are skipped
+func (r *rotator) rotateUser(ctx context.Context, user configuration.MongoUser) rotationResult {
+	age := ""
+	if r.maxAge > 0 {
+		current, found, err := secretAge(ctx, r.store, user)
+		if err != nil {
+			log.Printf("unable to read the secret age of %s for the DB %s: %v", user.Username, user.DBName, err)
+			return failed(user, "", err)
+		}
+		age = formatAge(current, found)
+		if found && current < r.maxAge {
+			log.Printf("skipping %s of the DB %s: secret is %s old", user.Username, user.DBName, age)
+			result := skipped(user, fmt.Sprintf("secret is younger than %s", formatAge(r.maxAge, true)))
+			result.Age = age
+			return result
+		}
+	}
+
+	result := r.rotate(ctx, user)
+	result.Age = age
+	if result.Outcome == OutcomeRotated {
+		r.prune(ctx, user)
+		if err := r.publish(ctx, user); err != nil {
+			//the workload keeps a password Atlas no longer accepts: the user fails so that -resume rotates it again
+			log.Printf("rotated %s of the DB %s but its Kubernetes Secret is not updated: %v", user.Username, user.DBName, err)
+			result.Outcome = OutcomeFailed
+			result.Error = "kubernetes: " + err.Error()
+		}
+	}
+	return result
+}
+
+//prune applies gcp.retention to the secret of a rotated user, a failure is logged but doesn't fail the rotation
+func (r *rotator) prune(ctx context.Context, user configuration.MongoUser) {
+	pruner, ok := r.store.(secrets.Pruner)
+	if !ok || !config.GCP.Retention.Enabled() {
+		return
+	}
+	actions, err := pruner.Prune(ctx, user, config.GCP.Retention, false)
+	if err != nil {
+		log.Printf("WARNING: unable to prune the secret versions of %s for the DB %s: %v", user.Username, user.DBName, err)
+	}
+	for _, action := range actions {
+		log.Printf("%s secret version %s of %s, created %s", pruned(action.Action), action.Version, user.Username, action.Created.Format(time.RFC3339))
+	}
+}
+
+//issueCertificate issues a new Atlas-managed certificate for an X.509 user and saves it as the secret of the user.
+//The previous certificates stay valid until they expire, so there is nothing to roll back.
+func (r *rotator) issueCertificate(ctx context.Context, user configuration.MongoUser) rotationResult {
+	months := config.Rotation.CertificateMonths
+	if months <= 0 {
+		months = DefaultCertificateMonths
+	}
+	pem, err := mongo.IssueCertificate(user, months, config.Mongo)
+	if err != nil {
+		log.Printf("unable to issue a certificate for %s of the DB %s: %v", user.Username, user.DBName, err)
+		return failed(user, "", err)
+	}
+	secret, err := secretPayload(user, "", pem, r.connections)
+	if err != nil {
+		log.Printf("unable to build the secret of %s for the DB %s: %v", user.Username, user.DBName, err)
+		return failed(user, "", err)
+	}
+	version, err := r.store.SaveSecret(ctx, user, secret)
+	if err != nil {
+		log.Printf("unable to save the certificate of %s for the DB %s: %v", user.Username, user.DBName, err)
+		return failed(user, version, err)
+	}
+	log.Printf("issued a %d months certificate for %s of the DB %s", months, user.Username, user.DBName)
+	result := newRotationResult(user, OutcomeRotated)
+	result.AtlasStatus = http.StatusOK
+	result.SecretVersion = versionID(version)
+	return result
+}
+
+//rotate generates a password compliant with the policy and rotates it
+func (r *rotator) rotate(ctx context.Context, user configuration.MongoUser) rotationResult {
+	if r.issueCerts && user.IsAtlasManagedX509() {
+		return r.issueCertificate(ctx, user)
+	}
+	pwd, err := config.PasswordPolicy.Generate()
+	if err == nil {
+		//never trust the generator alone, the password is checked before it reaches Atlas
+		err = config.PasswordPolicy.Check(pwd)
+	}
+	if err != nil {
+		log.Printf("unable to generate a password for %s of the DB %s: %v", user.Username, user.DBName, err)
+		return failed(user, "", err)
+	}
+	//log.Printf("Updating user %s with new password %s", result.Username, pwd)
+	version, verified, err := r.rotatePassword(ctx, user, pwd)
+	if err != nil {
+		if errors.Is(err, secrets.ErrSecretMismatch) {
+			log.Printf("INTEGRITY CHECK FAILED: the secret store altered the new secret of %s for the DB %s", user.Username, user.DBName)
+		}
+		log.Printf("unable to change %s password for the DB %s: %v", user.Username, user.DBName, err)
+		result := failed(user, version, err)
+		result.Verified = verified
+		return result
+	}
+	result := newRotationResult(user, OutcomeRotated)
+	result.AtlasStatus = http.StatusOK
+	result.SecretVersion = versionID(version)
+	result.Verified = verified
+	return result
+}
+
+//rotatePassword rotates the password of a user so that the new password is never lost,
+//in two phases if the store can stage a version, see rotateStaged, else with rotateUnstaged.
+//The name of the new secret version and the verification status are returned.
+func (r *rotator) rotatePassword(ctx context.Context, user configuration.MongoUser, pwd string) (string, string, error) {
+	secret, err := secretPayload(user, pwd, "", r.connections)
+	if err != nil {
+		return "", "", fmt.Errorf("building secret: %w", err)
+	}
+	if stager, ok := r.store.(secrets.Stager); ok {
+		return r.rotateStaged(ctx, stager, user, pwd, secret)
+	}
+	return r.rotateUnstaged(ctx, user, pwd, secret)
+}
+
+//rotateStaged rotates the password of a user in two phases:
+//	1. the new password is staged as a disabled secret version
+//	2. Atlas is updated, the staged version is destroyed if that fails
+//	3. with verification enabled, the new password must authenticate against the clusters of the user,
+//	   the previous password is restored in Atlas if it doesn't
+//	4. the staged version is enabled, the previous password is restored in Atlas if that fails
+func (r *rotator) rotateStaged(ctx context.Context, stager secrets.Stager, user configuration.MongoUser, pwd, secret string) (string, string, error) {
+	client := r.store
+	//the previous password is read before a new version exists, a store may serve the staged one for a moment
+	_, previous, err := client.LatestSecret(ctx, user)
+	if err != nil && err != secrets.ErrNoSecretVersion {
+		return "", "", fmt.Errorf("reading previous secret: %w", err)
+	}
+	hasPrevious := err == nil
+
+	staged, err := stager.StageSecret(ctx, user, secret)
+	if err != nil {
+		if staged != "" {
+			//the version exists but could not be disabled, it must not outlive the failed rotation
+			if dErr := client.DestroyVersion(ctx, staged); dErr != nil {
+				recordRecovery(user, "stage", staged, dErr, "destroy the staged secret version, Atlas password was not changed")
+			}
+		}
+		return staged, "", fmt.Errorf("staging secret: %w", err)
+	}
+
+	if err := mongo.UpdatePassword(pwd, user, config.Mongo); err != nil {
+		if dErr := client.DestroyVersion(ctx, staged); dErr != nil {
+			recordRecovery(user, "atlas_update", staged, dErr, "destroy the staged secret version, Atlas password was not changed")
+		}
+		return staged, "", fmt.Errorf("updating Atlas password: %w", err)
+	}
+
+	verified, err := r.verifyPassword(user, pwd)
+	if err != nil {
+		log.Printf("VERIFICATION FAILED: new password of %s for the DB %s doesn't work: %v", user.Username, user.DBName, err)
+		if rErr := r.restorePassword(ctx, user, staged, previous, hasPrevious); rErr == errNoPreviousPassword {
+			recordRecovery(user, "verify", staged, err,
+				"first rotation of the user, there is no previous password to restore: Atlas has the new password which failed verification, check the user and enable the staged secret version or reset the password")
+		} else if rErr != nil {
+			recordRecovery(user, "verify", staged, fmt.Errorf("%v, restore: %v", err, rErr),
+				"Atlas has the new password which failed verification, check the user and enable the staged secret version or reset the password")
+		}
+		return staged, verified, fmt.Errorf("verifying new password: %w", err)
+	}
+
+	if err := stager.EnableVersion(ctx, staged); err != nil {
+		if rErr := r.restorePassword(ctx, user, staged, previous, hasPrevious); rErr == errNoPreviousPassword {
+			recordRecovery(user, "enable", staged, err,
+				"first rotation of the user, there is no previous password to restore: Atlas has the new password, enable the staged secret version to serve it")
+		} else if rErr != nil {
+			recordRecovery(user, "enable", staged, fmt.Errorf("%v, restore: %v", err, rErr),
+				"Atlas has the new password, enable the staged secret version to serve it")
+		}
+		return staged, verified, fmt.Errorf("enabling staged secret: %w", err)
+	}
+	return staged, verified, nil
+}
+
+//errNoPreviousPassword is returned by restorePassword on the first rotation of a user, the staged version is kept
+//as it holds the only password Atlas has
+var errNoPreviousPassword = errors.New("no previous password to restore")
+
+//restorePassword puts the previous password of a user back in Atlas and destroys the staged version
+func (r *rotator) restorePassword(ctx context.Context, user configuration.MongoUser, staged, previous string, hasPrevious bool) error {
+	if !hasPrevious {
+		return errNoPreviousPassword
+	}
+	if err := mongo.UpdatePassword(secretPassword(previous), user, config.Mongo); err != nil {
+		return fmt.Errorf("restoring previous password: %v", err)
+	}
+	log.Printf("previous password of %s for the DB %s is restored", user.Username, user.DBName)
+
+	if err := r.store.DestroyVersion(ctx, staged); err != nil {
+		recordRecovery(user, "restore", staged, err, "destroy the staged secret version, Atlas has the previous password")
+	}
+	return nil
+}
+
+//rotateUnstaged rotates the password of a user with a store which serves every version it saves:
+//	1. the previous secret is read, so that it can be saved again
+//	2. the new password is saved as the current version before Atlas has it, so that it can't be lost
+//	3. Atlas is updated and, with verification enabled, the new password must authenticate
+//	4. if either fails the previous secret is saved again, and put back in Atlas if Atlas has the new one
+//The name of the new version and the verification status are returned.
+func (r *rotator) rotateUnstaged(ctx context.Context, user configuration.MongoUser, pwd, secret string) (string, string, error) {
+	_, previous, err := r.store.LatestSecret(ctx, user)
+	if err != nil && err != secrets.ErrNoSecretVersion {
+		return "", "", fmt.Errorf("reading previous secret: %w", err)
+	}
+	hasPrevious := err == nil
+
+	saved, err := r.store.SaveSecret(ctx, user, secret)
+	if err != nil {
+		if saved != "" {
+			//the version exists but failed the write, eg: its checksum, it is reported and must not be served
+			if dErr := r.store.DestroyVersion(ctx, saved); dErr != nil {
+				recordRecovery(user, "save", saved, dErr, "destroy the secret version which failed to be saved, Atlas password was not changed")
+			}
+		}
+		return saved, "", fmt.Errorf("saving secret: %w", err)
+	}
+
+	if err := mongo.UpdatePassword(pwd, user, config.Mongo); err != nil {
+		r.revertSecret(ctx, user, "atlas_update", saved, previous, hasPrevious)
+		return saved, "", fmt.Errorf("updating Atlas password: %w", err)
+	}
+
+	verified, err := r.verifyPassword(user, pwd)
+	if err != nil {
+		log.Printf("VERIFICATION FAILED: new password of %s for the DB %s doesn't work: %v", user.Username, user.DBName, err)
+		if !hasPrevious {
+			recordRecovery(user, "verify", saved, err, "Atlas and the secret have the new password which failed verification, there is no previous password to restore")
+			return saved, verified, fmt.Errorf("verifying new password: %w", err)
+		}
+		if rErr := mongo.UpdatePassword(secretPassword(previous), user, config.Mongo); rErr != nil {
+			recordRecovery(user, "verify", saved, fmt.Errorf("%v, restore: %v", err, rErr),
+				"Atlas and the secret have the new password which failed verification, check the user or reset the password")
+			return saved, verified, fmt.Errorf("verifying new password: %w", err)
+		}
+		log.Printf("previous password of %s for the DB %s is restored", user.Username, user.DBName)
+		r.revertSecret(ctx, user, "verify", saved, previous, hasPrevious)
+		return saved, verified, fmt.Errorf("verifying new password: %w", err)
+	}
+	return saved, verified, nil
+}
+
+//revertSecret makes the previous secret of a user current again after a failed unstaged rotation
+//and destroys the version of the new password
+func (r *rotator) revertSecret(ctx context.Context, user configuration.MongoUser, step, saved, previous string, hasPrevious bool) {
+	if hasPrevious {
+		if _, err := r.store.SaveSecret(ctx, user, previous); err != nil {
+			recordRecovery(user, step, saved, err, "the secret serves a password Atlas doesn't have, save the previous password again")
+			return
+		}
+	}
+	if err := r.store.DestroyVersion(ctx, saved); err != nil {
+		recordRecovery(user, step, saved, err, "destroy the secret version of the password Atlas doesn't have")
+	}
+}
+
+//recoveryMu serializes the writes of the workers to RecoveryFile
+var recoveryMu sync.Mutex
+
+//recordRecovery logs a failed rotation step and appends it to RecoveryFile
+func recordRecovery(user configuration.MongoUser, step, staged string, err error, recovery string) {
+	record := recoveryRecord{
+		Time:          time.Now().Format(time.RFC3339),
+		ProjectID:     user.ProjectID,
+		Username:      user.Username,
+		DBName:        user.DBName,
+		Step:          step,
+		StagedVersion: staged,
+		Error:         err.Error(),
+		Recovery:      recovery,
+	}
+	log.Printf("RECOVERY NEEDED: user %s of the DB %s, step %s, staged version %s: %v. %s",
+		user.Username, user.DBName, step, staged, err, recovery)
+
+	line, mErr := json.Marshal(record)
+	if mErr != nil {
+		log.Println("recovery record marshal error:", mErr)
+		return
+	}
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	file, fErr := os.OpenFile(RecoveryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if fErr != nil {
+		log.Println("recovery record write error:", fErr)
+		return
+	}
+	defer file.Close()
+	if _, fErr = file.Write(append(line, '\n')); fErr != nil {
+		log.Println("recovery record write error:", fErr)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	mongo "mongo-util/mongo"
+	secrets "mongo-util/secrets"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Outcomes of the rotation of a user
+const (
+	OutcomeRotated = "rotated"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+//Formats of the rotation report
+const (
+	ReportCSV  = "csv"
+	ReportJSON = "json"
+)
+
+//RotationColumns for quick reference as we need to follow the same order
+var RotationColumns = []string{"Username", "Database", "Project", "Outcome", "AtlasStatus", "Error", "SecretName", "SecretVersion", "SecretAge", "Verified", "Timestamp"}
+
+//rotationResult is a row of the rotation report
+type rotationResult struct {
+	Username      string `json:"username"`
+	DBName        string `json:"database"`
+	ProjectName   string `json:"project"`
+	Outcome       string `json:"outcome"`
+	AtlasStatus   int    `json:"atlas_status,omitempty"`
+	Error         string `json:"error,omitempty"`
+	SecretName    string `json:"secret_name,omitempty"`
+	SecretVersion string `json:"secret_version,omitempty"`
+	Age           string `json:"secret_age,omitempty"`
+	Verified      string `json:"verified,omitempty"`
+	Timestamp     string `json:"timestamp"`
+}
+
+func newRotationResult(user configuration.MongoUser, outcome string) rotationResult {
+	//a user the secret name template can't name fails on save, the error is reported there
+	name, _ := secretName(user)
+	return rotationResult{
+		Username:    user.Username,
+		DBName:      user.DBName,
+		ProjectName: config.Mongo.ProjectName,
+		Outcome:     outcome,
+		SecretName:  name,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	}
+}
+
+//skipped is the result of a user left out of the rotation
+func skipped(user configuration.MongoUser, reason string) rotationResult {
+	result := newRotationResult(user, OutcomeSkipped)
+	result.SecretName = ""
+	result.Error = reason
+	return result
+}
+
+//failed is the result of a user whose rotation failed, the Atlas status and body are kept if Atlas refused it
+func failed(user configuration.MongoUser, version string, err error) rotationResult {
+	result := newRotationResult(user, OutcomeFailed)
+	result.SecretVersion = versionID(version)
+	result.Error = err.Error()
+	var atlasErr *mongo.AtlasError
+	if errors.As(err, &atlasErr) {
+		result.AtlasStatus = atlasErr.StatusCode
+		result.Error = atlasErr.Body
+	}
+	return result
+}
+
+//versionID is the version number at the end of a secret version resource name,
+//the versions of a secret saved to several stores are kept whole
+func versionID(version string) string {
+	if secrets.IsMultiVersionName(version) {
+		return version
+	}
+	return version[strings.LastIndex(version, "/")+1:]
+}
+
+func (r rotationResult) row() []string {
+	status := ""
+	if r.AtlasStatus != 0 {
+		status = strconv.Itoa(r.AtlasStatus)
+	}
+	return []string{r.Username, r.DBName, r.ProjectName, r.Outcome, status, r.Error, r.SecretName, r.SecretVersion, r.Age, r.Verified, r.Timestamp}
+}
+
+//validReportFormat checks the -report_format argument
+func validReportFormat(format string) error {
+	if format != ReportCSV && format != ReportJSON {
+		return fmt.Errorf("invalid %s %q, allowed values: %s, %s", ReportFormat, format, ReportCSV, ReportJSON)
+	}
+	return nil
+}
+
+//generateRotationReport writes the per user outcomes of a rotation run and logs the totals
+func generateRotationReport(projectName string, results []rotationResult, format string) error {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Outcome]++
+		if result.Verified == VerificationFailed {
+			log.Printf("VERIFICATION FAILED: %s of the DB %s: %s", result.Username, result.DBName, result.Error)
+		}
+	}
+	log.Printf("%d users rotated, %d users skipped, %d users failed", counts[OutcomeRotated], counts[OutcomeSkipped], counts[OutcomeFailed])
+
+	fileName := fmt.Sprintf("%s_rotation_%s", projectName, configuration.TimeNow())
+	if format == ReportJSON {
+		return mongo.GenerateJSON(results, fileName)
+	}
+
+	var entries = make([][]string, len(results)+1)
+	entries[0] = RotationColumns
+	for ind, result := range results {
+		entries[ind+1] = result.row()
+	}
+	return mongo.GenerateCSV(entries, fileName)
+}
+
+//SummaryColumns for quick reference as we need to follow the same order
+var SummaryColumns = []string{"Project", "ProjectId", "Rotated", "Skipped", "Failed", "Error"}
+
+//projectSummary is a row of the rotation summary, Error is set when the project could not be rotated
+type projectSummary struct {
+	Name    string
+	ID      string
+	Rotated int
+	Skipped int
+	Failed  int
+	Error   string
+}
+
+func (s *projectSummary) count(results []rotationResult) {
+	for _, result := range results {
+		switch result.Outcome {
+		case OutcomeRotated:
+			s.Rotated++
+		case OutcomeSkipped:
+			s.Skipped++
+		case OutcomeFailed:
+			s.Failed++
+		}
+	}
+}
+
+//generateRotationSummary logs the outcome of every project and, when several projects were rotated,
+//writes them to rotation_summary_<time>.csv
+func generateRotationSummary(summaries []projectSummary) error {
+	var entries = make([][]string, len(summaries)+1)
+	entries[0] = SummaryColumns
+	for ind, summary := range summaries {
+		log.Printf("project %s: %d rotated, %d skipped, %d failed %s", summary.Name, summary.Rotated, summary.Skipped, summary.Failed, summary.Error)
+		entries[ind+1] = []string{
+			summary.Name,
+			summary.ID,
+			strconv.Itoa(summary.Rotated),
+			strconv.Itoa(summary.Skipped),
+			strconv.Itoa(summary.Failed),
+			summary.Error,
+		}
+	}
+	if len(summaries) <= 1 {
+		return nil
+	}
+	return mongo.GenerateCSV(entries, fmt.Sprintf("rotation_summary_%s", configuration.TimeNow()))
+}
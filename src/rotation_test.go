@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	configuration "mongo-util/config"
+	secrets "mongo-util/secrets"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//testStore is a Stager keeping the versions of a single user in memory, the operations named in fail return an error
+type testStore struct {
+	mu       sync.Mutex
+	versions []*testVersion
+	//fail holds stage, disable (the version is staged but left enabled), enable, destroy and save
+	fail map[string]bool
+	//savesBeforeFailure are the saves which succeed before a failing save
+	savesBeforeFailure int
+	saves              int
+}
+
+type testVersion struct {
+	name      string
+	payload   string
+	enabled   bool
+	destroyed bool
+}
+
+func (s *testStore) add(payload string, enabled bool) string {
+	version := &testVersion{name: fmt.Sprintf("versions/%d", len(s.versions)+1), payload: payload, enabled: enabled}
+	s.versions = append(s.versions, version)
+	return version.name
+}
+
+func (s *testStore) find(name string) *testVersion {
+	for _, version := range s.versions {
+		if version.name == name && !version.destroyed {
+			return version
+		}
+	}
+	return nil
+}
+
+func (s *testStore) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail["save"] && s.saves >= s.savesBeforeFailure {
+		return "", errors.New("save refused")
+	}
+	s.saves++
+	return s.add(payload, true), nil
+}
+
+func (s *testStore) StageSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail["stage"] {
+		return "", errors.New("stage refused")
+	}
+	if s.fail["disable"] {
+		return s.add(payload, true), errors.New("disable refused")
+	}
+	return s.add(payload, false), nil
+}
+
+func (s *testStore) EnableVersion(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version := s.find(name)
+	if s.fail["enable"] || version == nil {
+		return errors.New("enable refused")
+	}
+	version.enabled = true
+	return nil
+}
+
+func (s *testStore) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		if version := s.versions[i]; version.enabled && !version.destroyed {
+			return version.name, version.payload, nil
+		}
+	}
+	return "", "", secrets.ErrNoSecretVersion
+}
+
+func (s *testStore) ListVersions(ctx context.Context, user configuration.MongoUser) ([]secrets.Version, error) {
+	return nil, nil
+}
+
+func (s *testStore) DestroyVersion(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version := s.find(name)
+	if s.fail["destroy"] || version == nil {
+		return errors.New("destroy refused")
+	}
+	version.destroyed = true
+	return nil
+}
+
+func (s *testStore) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	return nil
+}
+
+func (s *testStore) Close() error {
+	return nil
+}
+
+//unstagedStore hides StageSecret and EnableVersion, the rotation saves every version as current
+type unstagedStore struct {
+	secrets.Store
+}
+
+//testAtlas answers the PATCH of the password of a db user, the calls listed in fail (counted from 1) are refused
+type testAtlas struct {
+	mu       sync.Mutex
+	password string
+	calls    int
+	fail     map[int]bool
+}
+
+func (a *testAtlas) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls++
+	var body struct {
+		Password string `json:"password"`
+	}
+	if r.Method != http.MethodPatch || json.NewDecoder(r.Body).Decode(&body) != nil || a.fail[a.calls] {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errorCode":"INVALID_ATTRIBUTE"}`)
+		return
+	}
+	a.password = body.Password
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{}`)
+}
+
+//readRecoveries reads the records of RecoveryFile in the working directory
+func readRecoveries(t *testing.T) []recoveryRecord {
+	file, err := os.Open(RecoveryFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []recoveryRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record recoveryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%s line %q: %v", RecoveryFile, scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+//rotationTest is a rotation of the password of a user from "previous" (if set) to "new"
+type rotationTest struct {
+	name      string
+	unstaged  bool
+	previous  string
+	storeFail []string
+	//savesBeforeFailure with a failing save
+	savesBeforeFailure int
+	atlasFail          []int
+	//verify against a cluster which can't be reached, the new password doesn't authenticate
+	verifyFails bool
+
+	wantErr      string
+	wantAtlas    string
+	wantSecret   string
+	wantPatches  int
+	wantRecovery string
+}
+
+func TestRotatePassword(t *testing.T) {
+	tests := []rotationTest{
+		{name: "staged", previous: "previous", wantAtlas: "new", wantSecret: "new", wantPatches: 1},
+		{name: "staged first rotation", wantAtlas: "new", wantSecret: "new", wantPatches: 1},
+		{name: "stage failure", previous: "previous", storeFail: []string{"stage"},
+			wantErr: "staging secret", wantSecret: "previous"},
+		{name: "staged version left enabled", previous: "previous", storeFail: []string{"disable"},
+			wantErr: "staging secret", wantSecret: "previous"},
+		{name: "staged Atlas failure", previous: "previous", atlasFail: []int{1},
+			wantErr: "updating Atlas password", wantSecret: "previous", wantPatches: 1},
+		{name: "staged Atlas failure and destroy failure", previous: "previous", atlasFail: []int{1}, storeFail: []string{"destroy"},
+			wantErr: "updating Atlas password", wantSecret: "previous", wantPatches: 1, wantRecovery: "atlas_update"},
+		{name: "staged verify failure", previous: "previous", verifyFails: true,
+			wantErr: "verifying new password", wantAtlas: "previous", wantSecret: "previous", wantPatches: 2},
+		{name: "enable failure", previous: "previous", storeFail: []string{"enable"},
+			wantErr: "enabling staged secret", wantAtlas: "previous", wantSecret: "previous", wantPatches: 2},
+		{name: "enable failure and restore failure", previous: "previous", storeFail: []string{"enable"}, atlasFail: []int{2},
+			wantErr: "enabling staged secret", wantAtlas: "new", wantSecret: "previous", wantPatches: 2, wantRecovery: "enable"},
+		{name: "enable failure on the first rotation", storeFail: []string{"enable"},
+			wantErr: "enabling staged secret", wantAtlas: "new", wantPatches: 1, wantRecovery: "enable"},
+		{name: "verify failure on the first rotation", verifyFails: true,
+			wantErr: "verifying new password", wantAtlas: "new", wantPatches: 1, wantRecovery: "verify"},
+
+		{name: "unstaged", unstaged: true, previous: "previous", wantAtlas: "new", wantSecret: "new", wantPatches: 1},
+		{name: "unstaged save failure", unstaged: true, previous: "previous", storeFail: []string{"save"},
+			wantErr: "saving secret", wantSecret: "previous"},
+		{name: "unstaged Atlas failure", unstaged: true, previous: "previous", atlasFail: []int{1},
+			wantErr: "updating Atlas password", wantSecret: "previous", wantPatches: 1},
+		{name: "unstaged Atlas failure and revert failure", unstaged: true, previous: "previous", atlasFail: []int{1},
+			storeFail: []string{"save"}, savesBeforeFailure: 1,
+			wantErr: "updating Atlas password", wantSecret: "new", wantPatches: 1, wantRecovery: "atlas_update"},
+		{name: "unstaged verify failure", unstaged: true, previous: "previous", verifyFails: true,
+			wantErr: "verifying new password", wantAtlas: "previous", wantSecret: "previous", wantPatches: 2},
+		{name: "unstaged verify failure and restore failure", unstaged: true, previous: "previous", verifyFails: true, atlasFail: []int{2},
+			wantErr: "verifying new password", wantAtlas: "new", wantSecret: "new", wantPatches: 2, wantRecovery: "verify"},
+		{name: "unstaged verify failure on the first rotation", unstaged: true, verifyFails: true,
+			wantErr: "verifying new password", wantAtlas: "new", wantSecret: "new", wantPatches: 1, wantRecovery: "verify"},
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//RecoveryFile is written to the working directory
+			if err := os.Chdir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			atlas := &testAtlas{password: "unknown", fail: map[int]bool{}}
+			for _, call := range test.atlasFail {
+				atlas.fail[call] = true
+			}
+			server := httptest.NewServer(atlas)
+			defer server.Close()
+			config = configuration.Config{}
+			config.Mongo.AtlasEndPoint = server.URL
+			config.Mongo.ProjectID = "5f1a2b3c4d5e6f7a8b9c0d1e"
+
+			store := &testStore{fail: map[string]bool{}, savesBeforeFailure: test.savesBeforeFailure}
+			if test.previous != "" {
+				store.add(test.previous, true)
+				atlas.password = test.previous
+			}
+			for _, op := range test.storeFail {
+				store.fail[op] = true
+			}
+			r := &rotator{store: store}
+			if test.unstaged {
+				r.store = unstagedStore{store}
+			}
+			if test.verifyFails {
+				r.verify = configuration.Verify{Attempts: 1}
+				r.clusters = []configuration.Cluster{{Name: "cluster0"}}
+				r.clusters[0].ConnectionStrings.StandardSrv = "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100&connectTimeoutMS=100"
+			}
+			user := configuration.MongoUser{Username: "app", DBName: "admin", ProjectID: config.Mongo.ProjectID}
+
+			_, _, err := r.rotatePassword(context.Background(), user, "new")
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("rotatePassword: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("rotatePassword: got %v, want %q", err, test.wantErr)
+			}
+
+			wantAtlas := test.wantAtlas
+			if wantAtlas == "" {
+				wantAtlas = atlasInitial(test)
+			}
+			if atlas.password != wantAtlas {
+				t.Errorf("Atlas has %q, want %q", atlas.password, wantAtlas)
+			}
+			if atlas.calls != test.wantPatches {
+				t.Errorf("Atlas got %d PATCH, want %d", atlas.calls, test.wantPatches)
+			}
+			_, secret, err := store.LatestSecret(context.Background(), user)
+			if test.wantSecret == "" && err != secrets.ErrNoSecretVersion {
+				t.Errorf("the store serves %q %v, want no secret", secret, err)
+			}
+			if test.wantSecret != "" && secret != test.wantSecret {
+				t.Errorf("the store serves %q %v, want %q", secret, err, test.wantSecret)
+			}
+
+			records := readRecoveries(t)
+			if test.wantRecovery == "" && len(records) > 0 {
+				t.Errorf("unexpected recovery records %+v", records)
+			}
+			if test.wantRecovery != "" {
+				if len(records) != 1 || records[0].Step != test.wantRecovery || records[0].Username != "app" || records[0].Recovery == "" {
+					t.Fatalf("recovery records %+v, want one of the step %s", records, test.wantRecovery)
+				}
+				if test.previous == "" && !strings.Contains(records[0].Recovery, "no previous password") {
+					t.Errorf("the recovery of a first rotation tells %q", records[0].Recovery)
+				}
+			}
+		})
+	}
+}
+
+//atlasInitial is the password Atlas has before the rotation
+func atlasInitial(test rotationTest) string {
+	if test.previous != "" {
+		return test.previous
+	}
+	return "unknown"
+}
+
+//TestFirstRotationKeepsTheStagedVersion checks the staged version holding the only password Atlas has is not destroyed
+func TestFirstRotationKeepsTheStagedVersion(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	atlas := &testAtlas{fail: map[int]bool{}}
+	server := httptest.NewServer(atlas)
+	defer server.Close()
+	config = configuration.Config{}
+	config.Mongo.AtlasEndPoint = server.URL
+	store := &testStore{fail: map[string]bool{"enable": true}}
+	r := &rotator{store: store}
+
+	staged, _, err := r.rotatePassword(context.Background(), configuration.MongoUser{Username: "app", DBName: "admin"}, "new")
+	if err == nil {
+		t.Fatalf("rotatePassword succeeded with a failing enable")
+	}
+	version := store.find(staged)
+	if version == nil || version.payload != "new" {
+		t.Fatalf("the staged version %q holding the password of Atlas is gone", staged)
+	}
+	if records := readRecoveries(t); len(records) != 1 || records[0].StagedVersion != staged {
+		t.Fatalf("recovery records %+v, want the staged version %s", records, staged)
+	}
+}
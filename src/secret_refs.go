@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	gcp "mongo-util/gcp"
+	"os"
+	"strings"
+)
+
+//Schemes of the secret references accepted instead of the credentials themselves
+const (
+	RefGCPSecretManager = "gcpsm://"
+	RefEnv              = "env://"
+	RefFile             = "file://"
+)
+
+//isSecretRef tells if a value is a secret reference rather than the credential itself
+func isSecretRef(value string) bool {
+	for _, scheme := range []string{RefGCPSecretManager, RefEnv, RefFile} {
+		if strings.HasPrefix(value, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+//resolveSecretRef reads the credential a reference points to, other values are returned as they are:
+//	gcpsm://projects/<project>/secrets/<secret id>/versions/<version>, or gcpsm://<secret id> for the latest
+//	version of a secret of gcp.project_id
+//	env://<variable>
+//	file:///<path>, the trailing newline is dropped
+//A #<field> suffix reads a field of a JSON secret, eg: gcpsm://<org id>-atlas-api-key#private_key
+func resolveSecretRef(ctx context.Context, name, value string) (string, error) {
+	if !isSecretRef(value) {
+		return value, nil
+	}
+	ref, field := value, ""
+	if i := strings.LastIndex(value, "#"); i > 0 {
+		ref, field = value[:i], value[i+1:]
+	}
+
+	var resolved string
+	switch {
+	case strings.HasPrefix(ref, RefEnv):
+		variable := strings.TrimPrefix(ref, RefEnv)
+		env, ok := os.LookupEnv(variable)
+		if !ok {
+			return "", fmt.Errorf("%s: environment variable %s is not set", name, variable)
+		}
+		resolved = env
+	case strings.HasPrefix(ref, RefFile):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, RefFile))
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		resolved = strings.TrimRight(string(data), "\r\n")
+	case strings.HasPrefix(ref, RefGCPSecretManager):
+		version := strings.TrimPrefix(ref, RefGCPSecretManager)
+		if !strings.HasPrefix(version, "projects/") {
+			version = fmt.Sprintf("projects/%s/secrets/%s/versions/latest", config.GCP.ProjectID, version)
+		}
+		client, err := gcp.NewClient(ctx, config)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		defer client.Close()
+		if resolved, err = client.AccessSecret(ctx, version); err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if field != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(resolved), &fields); err != nil {
+			return "", fmt.Errorf("%s: %s is not a JSON secret", name, ref)
+		}
+		value, ok := fields[field].(string)
+		if !ok {
+			return "", fmt.Errorf("%s: %s has no %s field", name, ref, field)
+		}
+		resolved = value
+	}
+	log.Printf("%s resolved from %s", name, ref)
+	return resolved, nil
+}
+
+//warnPlainFlag warns about a credential given in clear on the command line, where ps and the build logs show it
+func warnPlainFlag(flagName, value string) {
+	if value != "" && !isSecretRef(value) {
+		log.Printf("WARNING: -%s is given in clear, pass a reference instead eg: env://VAR, file:///path or gcpsm://secret", flagName)
+	}
+}
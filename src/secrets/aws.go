@@ -0,0 +1,452 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	configuration "mongo-util/config"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//AWS staging labels, AWSCURRENT is the version served by default
+const (
+	awsCurrent = "AWSCURRENT"
+	awsPending = "AWSPENDING"
+)
+
+//AWS saves the secrets in AWS Secrets Manager. New passwords are staged with the AWSPENDING label
+//and moved to AWSCURRENT once Atlas has them, Secrets Manager moves AWSPREVIOUS on its own.
+type AWS struct {
+	config   configuration.Config
+	aws      configuration.AWS
+	endpoint *url.URL
+	client   *http.Client
+}
+
+var (
+	_ Store  = (*AWS)(nil)
+	_ Stager = (*AWS)(nil)
+)
+
+//AWSError is returned when Secrets Manager answers with an error, Type is the exception name eg: ResourceNotFoundException
+type AWSError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *AWSError) Error() string {
+	return fmt.Sprintf("aws returned %d %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+//isAWSError tells if err is the given Secrets Manager exception
+func isAWSError(err error, exception string) bool {
+	awsErr, ok := err.(*AWSError)
+	return ok && awsErr.Type == exception
+}
+
+//NewAWS reads the AWS settings, nothing is called until the first secret is saved
+func NewAWS(config configuration.Config) (*AWS, error) {
+	aws := config.SecretStore.AWS
+	if aws.Region == "" {
+		aws.Region = os.Getenv("AWS_REGION")
+	}
+	if aws.Region == "" {
+		aws.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if aws.Region == "" {
+		return nil, fmt.Errorf("secret_store.aws.region or AWS_REGION is required")
+	}
+	if aws.AccessKeyID == "" {
+		aws.AccessKeyID, aws.SecretAccessKey, aws.SessionToken = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if aws.AccessKeyID == "" || aws.SecretAccessKey == "" {
+		return nil, fmt.Errorf("secret_store.aws.access_key_id/secret_access_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY are required")
+	}
+	if aws.Endpoint == "" {
+		aws.Endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", aws.Region)
+	}
+	endpoint, err := url.Parse(aws.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret_store.aws.endpoint: %v", err)
+	}
+	if endpoint.Path == "" {
+		endpoint.Path = "/"
+	}
+	return &AWS{config: config, aws: aws, endpoint: endpoint, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+//AWSSecretName is the name of the secret of a user, <prefix><secret id>
+func AWSSecretName(config configuration.Config, user configuration.MongoUser) (string, error) {
+	secretID, err := SecretID(config, user)
+	if err != nil {
+		return "", err
+	}
+	return config.SecretStore.AWS.Prefix + secretID, nil
+}
+
+//call sends a Secrets Manager action signed with SigV4 and decodes the response into out
+func (a *AWS) call(ctx context.Context, action string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager."+action)
+	a.sign(req, body, time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errBody struct {
+			Type         string `json:"__type"`
+			Message      string `json:"message"`
+			MessageUpper string `json:"Message"`
+		}
+		_ = json.Unmarshal(data, &errBody)
+		awsErr := &AWSError{StatusCode: resp.StatusCode, Message: errBody.Message}
+		//the type may be qualified eg: com.amazonaws.secretsmanager#ResourceNotFoundException
+		awsErr.Type = errBody.Type[strings.LastIndex(errBody.Type, "#")+1:]
+		if awsErr.Message == "" {
+			awsErr.Message = errBody.MessageUpper
+		}
+		return awsErr
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decode aws response: %v", err)
+		}
+	}
+	return nil
+}
+
+//sign adds the AWS Signature Version 4 headers to a request
+func (a *AWS) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.aws.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.aws.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + a.aws.Region + "/secretsmanager/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+a.aws.SecretAccessKey), date)
+	key = hmacSHA256(key, a.aws.Region)
+	key = hmacSHA256(key, "secretsmanager")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.aws.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//requestToken is a random UUID, Secrets Manager requires one per new version when the SDK isn't used
+func requestToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+//awsTag is a Secrets Manager tag
+type awsTag struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+//tags are the annotations of the secret of a user and secret_store.aws.tags
+func (a *AWS) tags(user *configuration.MongoUser) []awsTag {
+	values := Annotations(a.config, user)
+	for key, value := range a.aws.Tags {
+		values[key] = value
+	}
+	var tags []awsTag
+	for key, value := range values {
+		tags = append(tags, awsTag{Key: key, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags
+}
+
+//ensureSecret creates the secret of a user without any version if it doesn't exist, and tags it
+func (a *AWS) ensureSecret(ctx context.Context, name string, user configuration.MongoUser) error {
+	tags := a.tags(&user)
+	create := map[string]interface{}{
+		"Name":        name,
+		"Description": fmt.Sprintf("MongoDB Atlas credentials of %s for the DB %s", user.Username, user.DBName),
+		"Tags":        tags,
+	}
+	if a.aws.KMSKeyID != "" {
+		create["KmsKeyId"] = a.aws.KMSKeyID
+	}
+	err := a.call(ctx, "CreateSecret", create, nil)
+	if err == nil {
+		return nil
+	}
+	if !isAWSError(err, "ResourceExistsException") {
+		return fmt.Errorf("failed to create aws secret %s: %v", name, err)
+	}
+	if err := a.call(ctx, "TagResource", map[string]interface{}{"SecretId": name, "Tags": tags}, nil); err != nil {
+		return fmt.Errorf("failed to tag aws secret %s: %v", name, err)
+	}
+	return nil
+}
+
+//putVersion adds a version with the given staging label to the secret of a user and returns its name
+func (a *AWS) putVersion(ctx context.Context, user configuration.MongoUser, payload, stage string) (string, error) {
+	name, err := AWSSecretName(a.config, user)
+	if err != nil {
+		return "", err
+	}
+	if err := a.ensureSecret(ctx, name, user); err != nil {
+		return "", err
+	}
+	token, err := requestToken()
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		VersionID string `json:"VersionId"`
+	}
+	err = a.call(ctx, "PutSecretValue", map[string]interface{}{
+		"SecretId":           name,
+		"SecretString":       payload,
+		"ClientRequestToken": token,
+		"VersionStages":      []string{stage},
+	}, &response)
+	if err != nil {
+		return "", fmt.Errorf("failed to put aws secret value %s: %v", name, err)
+	}
+	return awsVersionName(name, response.VersionID), nil
+}
+
+//awsVersionName names a version of a secret: <secret name>?versionId=<id>
+func awsVersionName(name, versionID string) string {
+	return name + "?versionId=" + versionID
+}
+
+func parseAWSVersionName(name string) (string, string, error) {
+	parts := strings.SplitN(name, "?versionId=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid aws secret version %q", name)
+	}
+	return parts[0], parts[1], nil
+}
+
+//SaveSecret adds a new AWSCURRENT version to the secret of a user
+func (a *AWS) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	return a.putVersion(ctx, user, payload, awsCurrent)
+}
+
+//StageSecret adds a new AWSPENDING version to the secret of a user, it is not served until EnableVersion
+func (a *AWS) StageSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	return a.putVersion(ctx, user, payload, awsPending)
+}
+
+//versionStages are the staging labels of the versions of a secret
+func (a *AWS) versionStages(ctx context.Context, name string) (map[string][]string, error) {
+	var response struct {
+		VersionIdsToStages map[string][]string `json:"VersionIdsToStages"`
+	}
+	if err := a.call(ctx, "DescribeSecret", map[string]string{"SecretId": name}, &response); err != nil {
+		return nil, fmt.Errorf("failed to describe aws secret %s: %v", name, err)
+	}
+	return response.VersionIdsToStages, nil
+}
+
+//EnableVersion moves AWSCURRENT to a staged version
+func (a *AWS) EnableVersion(ctx context.Context, version string) error {
+	name, versionID, err := parseAWSVersionName(version)
+	if err != nil {
+		return err
+	}
+	stages, err := a.versionStages(ctx, name)
+	if err != nil {
+		return err
+	}
+	move := map[string]string{"SecretId": name, "VersionStage": awsCurrent, "MoveToVersionId": versionID}
+	for id, labels := range stages {
+		if id != versionID && hasStage(labels, awsCurrent) {
+			move["RemoveFromVersionId"] = id
+		}
+	}
+	if err := a.call(ctx, "UpdateSecretVersionStage", move, nil); err != nil {
+		return fmt.Errorf("failed to make aws secret version %s current: %v", version, err)
+	}
+	//the version is served, the leftover label is only cosmetic
+	unstage := map[string]string{"SecretId": name, "VersionStage": awsPending, "RemoveFromVersionId": versionID}
+	if err := a.call(ctx, "UpdateSecretVersionStage", unstage, nil); err != nil {
+		log.Printf("WARNING: unable to remove %s from aws secret version %s: %v", awsPending, version, err)
+	}
+	return nil
+}
+
+func hasStage(stages []string, stage string) bool {
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+//DestroyVersion removes the staging labels of a version, Secrets Manager deletes the versions without label.
+//The AWSCURRENT version can't be destroyed.
+func (a *AWS) DestroyVersion(ctx context.Context, version string) error {
+	name, versionID, err := parseAWSVersionName(version)
+	if err != nil {
+		return err
+	}
+	stages, err := a.versionStages(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, stage := range stages[versionID] {
+		if stage == awsCurrent {
+			return fmt.Errorf("aws secret version %s is the current one and can't be destroyed", version)
+		}
+		unstage := map[string]string{"SecretId": name, "VersionStage": stage, "RemoveFromVersionId": versionID}
+		if err := a.call(ctx, "UpdateSecretVersionStage", unstage, nil); err != nil {
+			return fmt.Errorf("failed to remove %s from aws secret version %s: %v", stage, version, err)
+		}
+	}
+	return nil
+}
+
+//LatestSecret reads the AWSCURRENT version of the secret of a user
+func (a *AWS) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	name, err := AWSSecretName(a.config, user)
+	if err != nil {
+		return "", "", err
+	}
+	var response struct {
+		VersionID    string `json:"VersionId"`
+		SecretString string `json:"SecretString"`
+	}
+	err = a.call(ctx, "GetSecretValue", map[string]string{"SecretId": name}, &response)
+	if isAWSError(err, "ResourceNotFoundException") {
+		return "", "", ErrNoSecretVersion
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get aws secret value %s: %v", name, err)
+	}
+	return awsVersionName(name, response.VersionID), response.SecretString, nil
+}
+
+//ListVersions lists the labelled versions of the secret of a user newest first, only AWSCURRENT is enabled
+func (a *AWS) ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error) {
+	name, err := AWSSecretName(a.config, user)
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	request := map[string]interface{}{"SecretId": name, "MaxResults": 100}
+	for {
+		var response struct {
+			Versions []struct {
+				VersionID     string   `json:"VersionId"`
+				VersionStages []string `json:"VersionStages"`
+				CreatedDate   float64  `json:"CreatedDate"`
+			} `json:"Versions"`
+			NextToken string `json:"NextToken"`
+		}
+		err := a.call(ctx, "ListSecretVersionIds", request, &response)
+		if isAWSError(err, "ResourceNotFoundException") {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of aws secret %s: %v", name, err)
+		}
+		for _, version := range response.Versions {
+			versions = append(versions, Version{
+				Name:    awsVersionName(name, version.VersionID),
+				Created: time.Unix(0, int64(version.CreatedDate*float64(time.Second))),
+				Enabled: hasStage(version.VersionStages, awsCurrent),
+			})
+		}
+		if response.NextToken == "" {
+			break
+		}
+		request["NextToken"] = response.NextToken
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Created.After(versions[j].Created) })
+	return versions, nil
+}
+
+//DeleteSecret deletes the secret of a user right away, without the recovery window, so that it can be created again
+func (a *AWS) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	name, err := AWSSecretName(a.config, user)
+	if err != nil {
+		return err
+	}
+	err = a.call(ctx, "DeleteSecret", map[string]interface{}{"SecretId": name, "ForceDeleteWithoutRecovery": true}, nil)
+	if err != nil && !isAWSError(err, "ResourceNotFoundException") {
+		return fmt.Errorf("failed to delete aws secret %s: %v", name, err)
+	}
+	return nil
+}
+
+//Close has nothing to release
+func (a *AWS) Close() error {
+	return nil
+}
@@ -0,0 +1,376 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	configuration "mongo-util/config"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+//fakeAWSVersion is a version of a secret of the fake Secrets Manager
+type fakeAWSVersion struct {
+	id      string
+	value   string
+	stages  []string
+	created time.Time
+}
+
+//fakeAWSSecret is a secret of the fake Secrets Manager
+type fakeAWSSecret struct {
+	tags     map[string]string
+	versions []*fakeAWSVersion
+}
+
+//fakeAWS answers the Secrets Manager JSON API actions used by the AWS store
+type fakeAWS struct {
+	*fakeServer
+	secrets map[string]*fakeAWSSecret
+}
+
+func newFakeAWS(t *testing.T) (*fakeAWS, string) {
+	fake := &fakeAWS{secrets: map[string]*fakeAWSSecret{}}
+	var endpoint string
+	fake.fakeServer, endpoint = newFakeServer(t, "application/x-amz-json-1.1", fake.handle)
+	return fake, endpoint
+}
+
+func awsAction(call fakeCall) string {
+	return strings.TrimPrefix(call.header.Get("X-Amz-Target"), "secretsmanager.")
+}
+
+func awsException(exception, message string) (int, interface{}) {
+	return http.StatusBadRequest, map[string]string{"__type": "com.amazonaws.secretsmanager#" + exception, "message": message}
+}
+
+//removeStage removes a staging label from the given versions
+func removeStage(versions []*fakeAWSVersion, stage string) {
+	for _, version := range versions {
+		var stages []string
+		for _, s := range version.stages {
+			if s != stage {
+				stages = append(stages, s)
+			}
+		}
+		version.stages = stages
+	}
+}
+
+//moveStage moves a staging label to a version, the version losing AWSCURRENT becomes AWSPREVIOUS
+func (s *fakeAWSSecret) moveStage(stage string, to *fakeAWSVersion) {
+	if stage == awsCurrent {
+		for _, version := range s.versions {
+			if hasStage(version.stages, awsCurrent) {
+				removeStage(s.versions, "AWSPREVIOUS")
+				version.stages = append(version.stages, "AWSPREVIOUS")
+			}
+		}
+	}
+	removeStage(s.versions, stage)
+	if to != nil {
+		to.stages = append(to.stages, stage)
+	}
+}
+
+func (f *fakeAWS) handle(call fakeCall) (int, interface{}) {
+	action := awsAction(call)
+	name, _ := call.body["Name"].(string)
+	if secretID, ok := call.body["SecretId"].(string); ok {
+		name = secretID
+	}
+	secret := f.secrets[name]
+	if secret == nil && action != "CreateSecret" {
+		return awsException("ResourceNotFoundException", "Secrets Manager can't find the specified secret.")
+	}
+
+	switch action {
+	case "CreateSecret":
+		if secret != nil {
+			return awsException("ResourceExistsException", "The operation failed because the secret "+name+" already exists.")
+		}
+		f.secrets[name] = &fakeAWSSecret{tags: fakeAWSTags(call.body)}
+		return http.StatusOK, map[string]string{"Name": name}
+	case "TagResource":
+		for key, value := range fakeAWSTags(call.body) {
+			secret.tags[key] = value
+		}
+		return http.StatusOK, map[string]string{}
+	case "PutSecretValue":
+		version := &fakeAWSVersion{
+			id:      fmt.Sprintf("v%d", len(secret.versions)+1),
+			value:   call.body["SecretString"].(string),
+			created: time.Now().Add(time.Duration(len(secret.versions)) * time.Second),
+		}
+		secret.versions = append(secret.versions, version)
+		for _, stage := range call.body["VersionStages"].([]interface{}) {
+			secret.moveStage(stage.(string), version)
+		}
+		return http.StatusOK, map[string]interface{}{"VersionId": version.id, "VersionStages": version.stages}
+	case "DescribeSecret":
+		stages := map[string][]string{}
+		for _, version := range secret.versions {
+			if len(version.stages) > 0 {
+				stages[version.id] = version.stages
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"Name": name, "VersionIdsToStages": stages}
+	case "UpdateSecretVersionStage":
+		stage := call.body["VersionStage"].(string)
+		for _, version := range secret.versions {
+			if version.id == call.body["MoveToVersionId"] {
+				secret.moveStage(stage, version)
+			} else if version.id == call.body["RemoveFromVersionId"] && call.body["MoveToVersionId"] == nil {
+				removeStage([]*fakeAWSVersion{version}, stage)
+			}
+		}
+		return http.StatusOK, map[string]string{"Name": name}
+	case "GetSecretValue":
+		for _, version := range secret.versions {
+			if hasStage(version.stages, awsCurrent) {
+				return http.StatusOK, map[string]interface{}{"VersionId": version.id, "SecretString": version.value}
+			}
+		}
+		return awsException("ResourceNotFoundException", "Secrets Manager can't find the specified secret value for staging label: AWSCURRENT")
+	case "ListSecretVersionIds":
+		var versions []map[string]interface{}
+		for _, version := range secret.versions {
+			if len(version.stages) > 0 {
+				versions = append(versions, map[string]interface{}{
+					"VersionId":     version.id,
+					"VersionStages": version.stages,
+					"CreatedDate":   float64(version.created.UnixNano()) / float64(time.Second),
+				})
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"Versions": versions}
+	case "DeleteSecret":
+		delete(f.secrets, name)
+		return http.StatusOK, map[string]string{"Name": name}
+	}
+	return awsException("InvalidAction", "unsupported action "+action)
+}
+
+func fakeAWSTags(body map[string]interface{}) map[string]string {
+	tags := map[string]string{}
+	list, _ := body["Tags"].([]interface{})
+	for _, tag := range list {
+		tag := tag.(map[string]interface{})
+		tags[tag["Key"].(string)] = tag["Value"].(string)
+	}
+	return tags
+}
+
+//stages are the staging labels of a version of the fake, by version id
+func (f *fakeAWS) stages(name, versionID string) []string {
+	for _, version := range f.secrets[name].versions {
+		if version.id == versionID {
+			return version.stages
+		}
+	}
+	return nil
+}
+
+//actions lists the actions received after the first n calls
+func (f *fakeAWS) actions(n int) string {
+	var actions []string
+	for _, call := range f.since(n) {
+		actions = append(actions, awsAction(call))
+	}
+	return strings.Join(actions, ",")
+}
+
+func awsTestStore(t *testing.T, endpoint string) *AWS {
+	var config configuration.Config
+	config.SecretStore.Type = configuration.StoreAWS
+	config.SecretStore.AWS = configuration.AWS{
+		Region:          "eu-west-1",
+		Endpoint:        endpoint,
+		Prefix:          "mongo/",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "session",
+		Tags:            map[string]string{"team": "dba"},
+	}
+	aws, err := NewAWS(config)
+	if err != nil {
+		t.Fatalf("NewAWS: %v", err)
+	}
+	return aws
+}
+
+var awsTestUser = configuration.MongoUser{Username: "app", DBName: "admin", ProjectID: "5f1a2b3c4d5e6f7a8b9c0d1e", ProjectName: "zebra"}
+
+const awsTestSecret = "mongo/5f1a2b3c4d5e6f7a8b9c0d1e-app"
+
+func TestAWSCreateAndTagSecret(t *testing.T) {
+	fake, endpoint := newFakeAWS(t)
+	store := awsTestStore(t, endpoint)
+	ctx := context.Background()
+
+	if _, _, err := store.LatestSecret(ctx, awsTestUser); err != ErrNoSecretVersion {
+		t.Fatalf("LatestSecret of a missing secret: got %v, want ErrNoSecretVersion", err)
+	}
+
+	start := len(fake.calls)
+	first, err := store.SaveSecret(ctx, awsTestUser, "first-password")
+	if err != nil {
+		t.Fatalf("SaveSecret of a missing secret: %v", err)
+	}
+	if got, want := fake.actions(start), "CreateSecret,PutSecretValue"; got != want {
+		t.Fatalf("SaveSecret of a missing secret called %s, want %s", got, want)
+	}
+	if want := awsTestSecret + "?versionId=v1"; first != want {
+		t.Fatalf("SaveSecret returned %q, want %q", first, want)
+	}
+	tags := fake.secrets[awsTestSecret].tags
+	if tags["team"] != "dba" || tags["mongo-util.username"] != "app" {
+		t.Fatalf("created secret tags are %v", tags)
+	}
+
+	//an existing secret is tagged again instead
+	fake.secrets[awsTestSecret].tags = map[string]string{}
+	start = len(fake.calls)
+	second, err := store.SaveSecret(ctx, awsTestUser, "second-password")
+	if err != nil {
+		t.Fatalf("SaveSecret of an existing secret: %v", err)
+	}
+	if got, want := fake.actions(start), "CreateSecret,TagResource,PutSecretValue"; got != want {
+		t.Fatalf("SaveSecret of an existing secret called %s, want %s", got, want)
+	}
+	if tags := fake.secrets[awsTestSecret].tags; tags["team"] != "dba" || tags["mongo-util.database"] != "admin" {
+		t.Fatalf("tags after TagResource are %v", tags)
+	}
+	put := fake.calls[len(fake.calls)-1].body
+	if stages := put["VersionStages"].([]interface{}); len(stages) != 1 || stages[0] != awsCurrent {
+		t.Fatalf("SaveSecret put the stages %v, want AWSCURRENT", stages)
+	}
+	if token, _ := put["ClientRequestToken"].(string); !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(token) {
+		t.Fatalf("ClientRequestToken %q is not a UUID v4", token)
+	}
+
+	name, payload, err := store.LatestSecret(ctx, awsTestUser)
+	if err != nil || name != second || payload != "second-password" {
+		t.Fatalf("LatestSecret returned %q %q %v, want %q second-password", name, payload, err, second)
+	}
+	versions, err := store.ListVersions(ctx, awsTestUser)
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Name != second || !versions[0].Enabled || versions[1].Enabled {
+		t.Fatalf("ListVersions returned %+v", versions)
+	}
+
+	if err := store.DeleteSecret(ctx, awsTestUser); err != nil {
+		t.Fatalf("DeleteSecret: %v", err)
+	}
+	if force := fake.calls[len(fake.calls)-1].body["ForceDeleteWithoutRecovery"]; force != true {
+		t.Fatalf("DeleteSecret sent ForceDeleteWithoutRecovery=%v", force)
+	}
+	if err := store.DeleteSecret(ctx, awsTestUser); err != nil {
+		t.Fatalf("DeleteSecret of a missing secret: %v", err)
+	}
+}
+
+func TestAWSStageAndEnable(t *testing.T) {
+	fake, endpoint := newFakeAWS(t)
+	store := awsTestStore(t, endpoint)
+	ctx := context.Background()
+
+	current, err := store.SaveSecret(ctx, awsTestUser, "current-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	staged, err := store.StageSecret(ctx, awsTestUser, "staged-password")
+	if err != nil {
+		t.Fatalf("StageSecret: %v", err)
+	}
+	if stages := fake.stages(awsTestSecret, "v2"); len(stages) != 1 || stages[0] != awsPending {
+		t.Fatalf("staged version has the stages %v, want AWSPENDING", stages)
+	}
+	//the staged password is not served
+	if name, payload, err := store.LatestSecret(ctx, awsTestUser); err != nil || name != current || payload != "current-password" {
+		t.Fatalf("LatestSecret with a staged version returned %q %q %v", name, payload, err)
+	}
+
+	start := len(fake.calls)
+	if err := store.EnableVersion(ctx, staged); err != nil {
+		t.Fatalf("EnableVersion: %v", err)
+	}
+	if got, want := fake.actions(start), "DescribeSecret,UpdateSecretVersionStage,UpdateSecretVersionStage"; got != want {
+		t.Fatalf("EnableVersion called %s, want %s", got, want)
+	}
+	move := fake.calls[start+1].body
+	if move["VersionStage"] != awsCurrent || move["MoveToVersionId"] != "v2" || move["RemoveFromVersionId"] != "v1" {
+		t.Fatalf("EnableVersion moved %v, want AWSCURRENT from v1 to v2", move)
+	}
+	if stages := fake.stages(awsTestSecret, "v2"); len(stages) != 1 || stages[0] != awsCurrent {
+		t.Fatalf("enabled version has the stages %v, want AWSCURRENT only", stages)
+	}
+	if stages := fake.stages(awsTestSecret, "v1"); len(stages) != 1 || stages[0] != "AWSPREVIOUS" {
+		t.Fatalf("previous version has the stages %v, want AWSPREVIOUS", stages)
+	}
+	if name, payload, err := store.LatestSecret(ctx, awsTestUser); err != nil || name != staged || payload != "staged-password" {
+		t.Fatalf("LatestSecret after EnableVersion returned %q %q %v", name, payload, err)
+	}
+
+	if err := store.DestroyVersion(ctx, staged); err == nil {
+		t.Fatalf("DestroyVersion of the AWSCURRENT version succeeded")
+	}
+	if err := store.DestroyVersion(ctx, current); err != nil {
+		t.Fatalf("DestroyVersion: %v", err)
+	}
+	if stages := fake.stages(awsTestSecret, "v1"); len(stages) != 0 {
+		t.Fatalf("destroyed version still has the stages %v", stages)
+	}
+}
+
+func TestAWSSignature(t *testing.T) {
+	fake, endpoint := newFakeAWS(t)
+	store := awsTestStore(t, endpoint)
+	if _, err := store.SaveSecret(context.Background(), awsTestUser, "password"); err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+
+	authorization := regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/(\d{8})/eu-west-1/secretsmanager/aws4_request, ` +
+		`SignedHeaders=([a-z0-9;-]+), Signature=[0-9a-f]{64}$`)
+	for _, call := range fake.calls {
+		action := awsAction(call)
+		amzDate := call.header.Get("X-Amz-Date")
+		if _, err := time.Parse("20060102T150405Z", amzDate); err != nil {
+			t.Fatalf("%s: X-Amz-Date %q: %v", action, amzDate, err)
+		}
+		match := authorization.FindStringSubmatch(call.header.Get("Authorization"))
+		if match == nil {
+			t.Fatalf("%s: invalid Authorization header %q", action, call.header.Get("Authorization"))
+		}
+		if match[1] != amzDate[:8] {
+			t.Fatalf("%s: credential scope date %s doesn't match X-Amz-Date %s", action, match[1], amzDate)
+		}
+		signed := ";" + match[2] + ";"
+		for _, header := range []string{"host", "x-amz-date", "x-amz-target", "x-amz-security-token", "content-type"} {
+			if !strings.Contains(signed, ";"+header+";") {
+				t.Fatalf("%s: %s is not signed: %s", action, header, match[2])
+			}
+		}
+		if call.header.Get("X-Amz-Security-Token") != "session" {
+			t.Fatalf("%s: X-Amz-Security-Token is missing", action)
+		}
+	}
+
+	//the signature depends on the body
+	req := httptest.NewRequest(http.MethodPost, endpoint, nil)
+	other := httptest.NewRequest(http.MethodPost, endpoint, nil)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.sign(req, []byte(`{"a":1}`), now)
+	store.sign(other, []byte(`{"a":2}`), now)
+	if req.Header.Get("Authorization") == other.Header.Get("Authorization") {
+		t.Fatalf("requests with different bodies got the same signature")
+	}
+	if req.Header.Get("X-Amz-Date") != "20240102T030405Z" {
+		t.Fatalf("X-Amz-Date is %q", req.Header.Get("X-Amz-Date"))
+	}
+}
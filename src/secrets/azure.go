@@ -0,0 +1,360 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	configuration "mongo-util/config"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureAPIVersion    = "7.4"
+	azureScope         = "https://vault.azure.net/.default"
+	azureAuthorityHost = "https://login.microsoftonline.com"
+)
+
+//Azure saves the secrets in Azure Key Vault, every save is a new version of the secret.
+//The current version of a Key Vault secret is its newest one even when it is disabled, so versions can't be staged.
+type Azure struct {
+	config configuration.Config
+	azure  configuration.Azure
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var _ Store = (*Azure)(nil)
+
+//AzureError is returned when Key Vault or Azure AD answers with an error
+type AzureError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *AzureError) Error() string {
+	return fmt.Sprintf("azure returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+//NewAzure reads the Key Vault settings, the token is fetched with the first call
+func NewAzure(config configuration.Config) (*Azure, error) {
+	azure := config.SecretStore.Azure
+	if azure.VaultURL == "" {
+		return nil, fmt.Errorf("secret_store.azure.vault_url is required")
+	}
+	azure.VaultURL = strings.TrimSuffix(azure.VaultURL, "/")
+	if azure.TenantID == "" {
+		azure.TenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	if azure.ClientID == "" {
+		azure.ClientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	if azure.ClientSecret == "" {
+		azure.ClientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	}
+	if azure.TenantID == "" || azure.ClientID == "" || azure.ClientSecret == "" {
+		return nil, fmt.Errorf("secret_store.azure tenant_id, client_id and client_secret or AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET are required")
+	}
+	if azure.AuthorityHost == "" {
+		azure.AuthorityHost = azureAuthorityHost
+	}
+	azure.AuthorityHost = strings.TrimSuffix(azure.AuthorityHost, "/")
+	return &Azure{config: config, azure: azure, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+//AzureSecretName is the name of the secret of a user, Key Vault names only allow letters, digits and -
+func AzureSecretName(config configuration.Config, user configuration.MongoUser) (string, error) {
+	secretID, err := SecretID(config, user)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(config.SecretStore.Azure.Prefix+secretID, "_", "-"), nil
+}
+
+//accessToken gets a Key Vault token with the client credentials grant, it is reused until a minute before it expires
+func (a *Azure) accessToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.azure.ClientID},
+		"client_secret": {a.azure.ClientSecret},
+		"scope":         {azureScope},
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.azure.AuthorityHost, url.PathEscape(a.azure.TenantID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("azure token: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil || resp.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return "", &AzureError{StatusCode: resp.StatusCode, Code: response.Error, Message: response.ErrorDescription}
+	}
+	a.token = response.AccessToken
+	a.expires = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	return a.token, nil
+}
+
+//call sends a request to the Key Vault API and decodes the response into out
+func (a *Azure) call(ctx context.Context, method, apiURL string, payload, out interface{}) error {
+	token, err := a.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errBody struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(data, &errBody)
+		return &AzureError{StatusCode: resp.StatusCode, Code: errBody.Error.Code, Message: errBody.Error.Message}
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("decode azure response: %v", err)
+		}
+	}
+	return nil
+}
+
+//secretURL is the Key Vault url of a secret, of one of its versions if version is set
+func (a *Azure) secretURL(name, version string) string {
+	secretURL := a.azure.VaultURL + "/secrets/" + url.PathEscape(name)
+	if version != "" {
+		secretURL += "/" + url.PathEscape(version)
+	}
+	return secretURL + "?api-version=" + azureAPIVersion
+}
+
+//isAzureNotFound tells if err is a missing secret or version
+func isAzureNotFound(err error) bool {
+	azureErr, ok := err.(*AzureError)
+	return ok && azureErr.StatusCode == http.StatusNotFound
+}
+
+//azureSecretBundle is a version of a secret as Key Vault returns it, ID is <vault>/secrets/<name>/<version>
+type azureSecretBundle struct {
+	ID         string `json:"id"`
+	Value      string `json:"value"`
+	Attributes struct {
+		Enabled bool  `json:"enabled"`
+		Created int64 `json:"created"`
+	} `json:"attributes"`
+}
+
+//versionName is the version url without the api version, the way Key Vault identifies it
+func (b azureSecretBundle) versionName() string {
+	return b.ID
+}
+
+//parseAzureVersionName gives back the secret name and version of a version url
+func parseAzureVersionName(name string) (string, string, error) {
+	parts := strings.Split(name, "/secrets/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid azure secret version %q", name)
+	}
+	path := strings.SplitN(parts[1], "/", 2)
+	if len(path) != 2 || path[1] == "" {
+		return "", "", fmt.Errorf("invalid azure secret version %q", name)
+	}
+	return path[0], path[1], nil
+}
+
+//contentType tells the JSON payloads from the bare passwords and certificates
+func contentType(payload string) string {
+	if strings.HasPrefix(payload, "{") && json.Valid([]byte(payload)) {
+		return "application/json"
+	}
+	return "text/plain"
+}
+
+//SaveSecret sets a new version of the secret of a user with its content type and tags
+func (a *Azure) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	name, err := AzureSecretName(a.config, user)
+	if err != nil {
+		return "", err
+	}
+	tags := Annotations(a.config, &user)
+	for key, value := range a.azure.Tags {
+		tags[key] = value
+	}
+	body := map[string]interface{}{
+		"value":       payload,
+		"contentType": contentType(payload),
+		"tags":        tags,
+	}
+	var bundle azureSecretBundle
+	if err := a.call(ctx, http.MethodPut, a.secretURL(name, ""), body, &bundle); err != nil {
+		return "", fmt.Errorf("failed to set azure secret %s: %v", name, err)
+	}
+	return bundle.versionName(), nil
+}
+
+//LatestSecret reads the newest enabled version of the secret of a user. Key Vault refuses to serve a secret whose
+//newest version is disabled, eg: by a failed revert, the versions are listed to find the enabled one then.
+func (a *Azure) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	name, err := AzureSecretName(a.config, user)
+	if err != nil {
+		return "", "", err
+	}
+	var bundle azureSecretBundle
+	err = a.call(ctx, http.MethodGet, a.secretURL(name, ""), nil, &bundle)
+	if isAzureForbidden(err) {
+		return a.latestEnabled(ctx, user, name)
+	}
+	if isAzureNotFound(err) {
+		return "", "", ErrNoSecretVersion
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get azure secret %s: %v", name, err)
+	}
+	return bundle.versionName(), bundle.Value, nil
+}
+
+//isAzureForbidden tells if err is a refused read, the answer of Key Vault to a disabled version
+func isAzureForbidden(err error) bool {
+	azureErr, ok := err.(*AzureError)
+	return ok && azureErr.StatusCode == http.StatusForbidden
+}
+
+//latestEnabled reads the newest enabled version of a secret, ErrNoSecretVersion is returned if there is none
+func (a *Azure) latestEnabled(ctx context.Context, user configuration.MongoUser, name string) (string, string, error) {
+	versions, err := a.ListVersions(ctx, user)
+	if err != nil {
+		return "", "", err
+	}
+	for _, version := range versions {
+		if !version.Enabled {
+			continue
+		}
+		_, id, err := parseAzureVersionName(version.Name)
+		if err != nil {
+			return "", "", err
+		}
+		var bundle azureSecretBundle
+		if err := a.call(ctx, http.MethodGet, a.secretURL(name, id), nil, &bundle); err != nil {
+			return "", "", fmt.Errorf("failed to get azure secret version %s: %v", version.Name, err)
+		}
+		return bundle.versionName(), bundle.Value, nil
+	}
+	return "", "", ErrNoSecretVersion
+}
+
+//ListVersions lists the versions of the secret of a user newest first
+func (a *Azure) ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error) {
+	name, err := AzureSecretName(a.config, user)
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	next := a.azure.VaultURL + "/secrets/" + url.PathEscape(name) + "/versions?api-version=" + azureAPIVersion
+	for next != "" {
+		var response struct {
+			Value    []azureSecretBundle `json:"value"`
+			NextLink string              `json:"nextLink"`
+		}
+		err := a.call(ctx, http.MethodGet, next, nil, &response)
+		if isAzureNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of azure secret %s: %v", name, err)
+		}
+		for _, bundle := range response.Value {
+			versions = append(versions, Version{
+				Name:    bundle.versionName(),
+				Created: time.Unix(bundle.Attributes.Created, 0),
+				Enabled: bundle.Attributes.Enabled,
+			})
+		}
+		next = response.NextLink
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Created.After(versions[j].Created) })
+	return versions, nil
+}
+
+//DestroyVersion disables a version, Key Vault can't delete a single version
+func (a *Azure) DestroyVersion(ctx context.Context, version string) error {
+	name, id, err := parseAzureVersionName(version)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{"attributes": map[string]bool{"enabled": false}}
+	if err := a.call(ctx, http.MethodPatch, a.secretURL(name, id), body, nil); err != nil {
+		return fmt.Errorf("failed to disable azure secret version %s: %v", version, err)
+	}
+	return nil
+}
+
+//DeleteSecret deletes the secret of a user with all its versions, with soft delete on the vault keeps
+//it recoverable and its name taken until the retention period ends or it is purged
+func (a *Azure) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	name, err := AzureSecretName(a.config, user)
+	if err != nil {
+		return err
+	}
+	err = a.call(ctx, http.MethodDelete, a.azure.VaultURL+"/secrets/"+url.PathEscape(name)+"?api-version="+azureAPIVersion, nil, nil)
+	if err != nil && !isAzureNotFound(err) {
+		return fmt.Errorf("failed to delete azure secret %s: %v", name, err)
+	}
+	return nil
+}
+
+//Close has nothing to release
+func (a *Azure) Close() error {
+	return nil
+}
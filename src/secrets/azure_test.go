@@ -0,0 +1,137 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	configuration "mongo-util/config"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//fakeAzureVersion is a version of a secret of the fake Key Vault
+type fakeAzureVersion struct {
+	id      string
+	value   string
+	enabled bool
+	created int64
+}
+
+//fakeAzure is a Key Vault and its Azure AD token endpoint, a secret holds its versions oldest first
+type fakeAzure struct {
+	address string
+	secrets map[string][]*fakeAzureVersion
+}
+
+func newFakeAzure(t *testing.T) *fakeAzure {
+	fake := &fakeAzure{secrets: map[string][]*fakeAzureVersion{}}
+	_, fake.address = newFakeServer(t, "application/json", fake.handle)
+	return fake
+}
+
+func (f *fakeAzure) bundle(name string, version *fakeAzureVersion) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         f.address + "/secrets/" + name + "/" + version.id,
+		"value":      version.value,
+		"attributes": map[string]interface{}{"enabled": version.enabled, "created": version.created},
+	}
+}
+
+func azureFailure(status int, code, message string) (int, interface{}) {
+	return status, map[string]interface{}{"error": map[string]string{"code": code, "message": message}}
+}
+
+func (f *fakeAzure) handle(call fakeCall) (int, interface{}) {
+	if strings.HasSuffix(call.path, "/oauth2/v2.0/token") {
+		return http.StatusOK, map[string]interface{}{"access_token": "azure-token", "expires_in": 3600}
+	}
+	if call.header.Get("Authorization") != "Bearer azure-token" {
+		return azureFailure(http.StatusUnauthorized, "Unauthorized", "invalid token")
+	}
+	path := strings.Split(strings.TrimPrefix(call.path, "/secrets/"), "/")
+	name, versions := path[0], f.secrets[path[0]]
+	if call.method == http.MethodPut {
+		version := &fakeAzureVersion{id: fmt.Sprintf("v%d", len(versions)+1), value: call.body["value"].(string), enabled: true,
+			created: time.Now().Unix() + int64(len(versions))}
+		f.secrets[name] = append(versions, version)
+		return http.StatusOK, f.bundle(name, version)
+	}
+	if len(versions) == 0 {
+		return azureFailure(http.StatusNotFound, "SecretNotFound", "secret not found")
+	}
+	if len(path) == 2 && path[1] == "versions" {
+		var listed []map[string]interface{}
+		for _, version := range versions {
+			bundle := f.bundle(name, version)
+			delete(bundle, "value")
+			listed = append(listed, bundle)
+		}
+		return http.StatusOK, map[string]interface{}{"value": listed}
+	}
+
+	version := versions[len(versions)-1]
+	if len(path) == 2 {
+		version = nil
+		for _, v := range versions {
+			if v.id == path[1] {
+				version = v
+			}
+		}
+		if version == nil {
+			return azureFailure(http.StatusNotFound, "SecretNotFound", "version not found")
+		}
+	}
+	if call.method == http.MethodPatch {
+		attributes := call.body["attributes"].(map[string]interface{})
+		version.enabled = attributes["enabled"].(bool)
+		return http.StatusOK, f.bundle(name, version)
+	}
+	if !version.enabled {
+		return azureFailure(http.StatusForbidden, "Forbidden", "Operation get is not allowed on a disabled secret.")
+	}
+	return http.StatusOK, f.bundle(name, version)
+}
+
+func TestAzureLatestSecretSkipsDisabledVersions(t *testing.T) {
+	fake := newFakeAzure(t)
+	var config configuration.Config
+	config.SecretStore.Type = configuration.StoreAzure
+	config.SecretStore.Azure = configuration.Azure{VaultURL: fake.address, AuthorityHost: fake.address, TenantID: "tenant", ClientID: "client", ClientSecret: "secret"}
+	azure, err := NewAzure(config)
+	if err != nil {
+		t.Fatalf("NewAzure: %v", err)
+	}
+	ctx := context.Background()
+	user := configuration.MongoUser{Username: "app", DBName: "admin", ProjectID: "5f1a2b3c4d5e6f7a8b9c0d1e"}
+
+	if _, _, err := azure.LatestSecret(ctx, user); err != ErrNoSecretVersion {
+		t.Fatalf("LatestSecret of a missing secret: got %v, want ErrNoSecretVersion", err)
+	}
+	first, err := azure.SaveSecret(ctx, user, "first-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	second, err := azure.SaveSecret(ctx, user, "second-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	if name, payload, err := azure.LatestSecret(ctx, user); err != nil || name != second || payload != "second-password" {
+		t.Fatalf("LatestSecret returned %q %q %v, want %s", name, payload, err, second)
+	}
+
+	//a failed revert leaves the newest version disabled, Key Vault refuses to serve the secret
+	if err := azure.DestroyVersion(ctx, second); err != nil {
+		t.Fatalf("DestroyVersion: %v", err)
+	}
+	if name, payload, err := azure.LatestSecret(ctx, user); err != nil || name != first || payload != "first-password" {
+		t.Fatalf("LatestSecret with a disabled newest version returned %q %q %v, want %s", name, payload, err, first)
+	}
+
+	if err := azure.DestroyVersion(ctx, first); err != nil {
+		t.Fatalf("DestroyVersion: %v", err)
+	}
+	if _, _, err := azure.LatestSecret(ctx, user); err != ErrNoSecretVersion {
+		t.Fatalf("LatestSecret without an enabled version: got %v, want ErrNoSecretVersion", err)
+	}
+}
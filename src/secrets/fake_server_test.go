@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//fakeCall is a request received by a fakeServer, with its JSON or form body decoded
+type fakeCall struct {
+	method string
+	path   string
+	header http.Header
+	body   map[string]interface{}
+}
+
+//fakeServer is an in-process API of a store: it records the calls and handle answers them with a status
+//and a body sent as JSON. handle runs under the lock of the server, it can keep its state without one.
+type fakeServer struct {
+	t           *testing.T
+	contentType string
+	handle      func(call fakeCall) (int, interface{})
+
+	mu    sync.Mutex
+	calls []fakeCall
+}
+
+//newFakeServer starts a fakeServer which is closed with the test and returns it with its url
+func newFakeServer(t *testing.T, contentType string, handle func(call fakeCall) (int, interface{})) (*fakeServer, string) {
+	fake := &fakeServer{t: t, contentType: contentType, handle: handle}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := fakeCall{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: map[string]interface{}{}}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		var form url.Values
+		if form, err = url.ParseQuery(string(data)); err == nil {
+			for key := range form {
+				call.body[key] = form.Get(key)
+			}
+		}
+	} else if err == nil && len(data) > 0 {
+		err = json.Unmarshal(data, &call.body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.calls = append(f.calls, call)
+
+	status, body := f.handle(call)
+	w.Header().Set("Content-Type", f.contentType)
+	w.WriteHeader(status)
+	if body != nil {
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			f.t.Errorf("encode the response to %s %s: %v", call.method, call.path, err)
+		}
+	}
+}
+
+//since are the calls received after the first n ones
+func (f *fakeServer) since(n int) []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeCall(nil), f.calls[n:]...)
+}
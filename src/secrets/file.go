@@ -0,0 +1,443 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"io/ioutil"
+	configuration "mongo-util/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultSecretsFile is the file store of secret_store.file when path is not set
+	DefaultSecretsFile = "secrets.enc"
+	//fileFormat is the version of the layout of the file, written to its header
+	fileFormat     = 1
+	fileKDF        = "pbkdf2-sha256"
+	fileIterations = 600000
+	fileSaltSize   = 16
+	fileKeySize    = 32
+)
+
+//File saves the secrets in a local file encrypted with AES-256-GCM. The whole file is decrypted when it is opened
+//and encrypted again with a new nonce on every change, so only one run must use a file at a time.
+type File struct {
+	config configuration.Config
+	path   string
+	secret []byte
+
+	mu   sync.Mutex
+	salt []byte
+	//iterations derived key, the ones of the file when it exists
+	iterations int
+	key        []byte
+	secrets    map[string]*FileSecret
+}
+
+var (
+	_ Store  = (*File)(nil)
+	_ Stager = (*File)(nil)
+)
+
+//FileSecret is a secret of the file store with all its versions, oldest first
+type FileSecret struct {
+	ID          string            `json:"id"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Versions    []FileVersion     `json:"versions"`
+}
+
+//FileVersion is a version of a secret of the file store, Payload is emptied when it is destroyed
+type FileVersion struct {
+	Number    int       `json:"number"`
+	Created   time.Time `json:"created"`
+	Enabled   bool      `json:"enabled"`
+	Destroyed bool      `json:"destroyed,omitempty"`
+	Payload   string    `json:"payload,omitempty"`
+}
+
+//fileEnvelope is the content of the file, the secrets are encrypted in Ciphertext
+type fileEnvelope struct {
+	Format     int    `json:"format"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+//ErrWrongSecretsKey is returned when the file can't be decrypted with the configured passphrase or key file
+var ErrWrongSecretsKey = errors.New("unable to decrypt the secrets file, wrong passphrase or key file")
+
+//NewFile opens the encrypted file of secret_store.file, it is created with the first saved secret if missing
+func NewFile(config configuration.Config) (*File, error) {
+	file := config.SecretStore.File
+	f := &File{config: config, path: file.Path, secrets: map[string]*FileSecret{}}
+	if f.path == "" {
+		f.path = DefaultSecretsFile
+	}
+
+	switch {
+	case file.KeyFile != "":
+		key, err := ioutil.ReadFile(file.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read secret_store.file.key_file: %v", err)
+		}
+		f.secret = bytes.TrimSpace(key)
+	case file.Passphrase != "":
+		f.secret = []byte(file.Passphrase)
+	default:
+		f.secret = []byte(os.Getenv("MONGO_UTIL_SECRETS_PASSPHRASE"))
+	}
+	if len(f.secret) == 0 {
+		return nil, fmt.Errorf("secret_store.file.key_file, secret_store.file.passphrase or MONGO_UTIL_SECRETS_PASSPHRASE is required")
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//fileAAD authenticates the header of the file with the secrets, not its path, so that the file can be moved
+func fileAAD(format int) []byte {
+	return []byte(fmt.Sprintf("mongo-util secrets file format %d", format))
+}
+
+//deriveKey stretches the passphrase or key file into an AES-256 key
+func deriveKey(secret, salt []byte, iterations int) []byte {
+	return pbkdf2.Key(secret, salt, iterations, fileKeySize, sha256.New)
+}
+
+//load decrypts the file, a missing file is an empty store with a new salt
+func (f *File) load() error {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		f.salt = make([]byte, fileSaltSize)
+		if _, err := rand.Read(f.salt); err != nil {
+			return err
+		}
+		f.iterations = fileIterations
+		f.key = deriveKey(f.secret, f.salt, f.iterations)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read secrets file %s: %v", f.path, err)
+	}
+
+	var envelope fileEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("secrets file %s is corrupted: %v", f.path, err)
+	}
+	if envelope.Format != fileFormat {
+		return fmt.Errorf("secrets file %s has the unsupported format %d", f.path, envelope.Format)
+	}
+	if envelope.KDF != fileKDF || envelope.Iterations <= 0 {
+		return fmt.Errorf("secrets file %s has the unsupported key derivation %s with %d iterations", f.path, envelope.KDF, envelope.Iterations)
+	}
+	f.salt = envelope.Salt
+	f.iterations = envelope.Iterations
+	f.key = deriveKey(f.secret, f.salt, f.iterations)
+	gcm, err := newGCM(f.key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, fileAAD(envelope.Format))
+	if err != nil {
+		return ErrWrongSecretsKey
+	}
+	var secrets []*FileSecret
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return fmt.Errorf("secrets file %s is corrupted: %v", f.path, err)
+	}
+	for _, secret := range secrets {
+		f.secrets[secret.ID] = secret
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//save encrypts the secrets with a new nonce and replaces the file, the caller holds mu and undoes its change
+//if save fails
+func (f *File) save() error {
+	plaintext, err := json.Marshal(f.sortedSecrets())
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(f.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fileEnvelope{
+		Format:     fileFormat,
+		KDF:        fileKDF,
+		Iterations: f.iterations,
+		Salt:       f.salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, fileAAD(fileFormat)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	//written next to the file and renamed so that an interrupted run never leaves a truncated file
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("write secrets file %s: %v", f.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write secrets file %s: %v", f.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write secrets file %s: %v", f.path, err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("write secrets file %s: %v", f.path, err)
+	}
+	return nil
+}
+
+func (f *File) sortedSecrets() []*FileSecret {
+	var secrets []*FileSecret
+	for _, secret := range f.secrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].ID < secrets[j].ID })
+	return secrets
+}
+
+//FileSecretName is the name of the secret of a user, <path>#<secret id>
+func FileSecretName(config configuration.Config, user configuration.MongoUser) (string, error) {
+	secretID, err := SecretID(config, user)
+	if err != nil {
+		return "", err
+	}
+	path := config.SecretStore.File.Path
+	if path == "" {
+		path = DefaultSecretsFile
+	}
+	return path + "#" + secretID, nil
+}
+
+//fileVersionName names a version like vault does: <secret id>?version=<n>
+func fileVersionName(secretID string, number int) string {
+	return fmt.Sprintf("%s?version=%d", secretID, number)
+}
+
+//parseFileVersionName is the reverse of fileVersionName
+func parseFileVersionName(name string) (string, int, error) {
+	parts := strings.SplitN(name, "?version=", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid secrets file version %q", name)
+	}
+	number, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid secrets file version %q", name)
+	}
+	return parts[0], number, nil
+}
+
+//addVersion appends a version to the secret of a user, enabled or staged. The version is removed again
+//if the file can't be written, a later save must not persist a version reported as failed.
+func (f *File) addVersion(user configuration.MongoUser, payload string, enabled bool) (string, error) {
+	secretID, err := SecretID(f.config, user)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, ok := f.secrets[secretID]
+	if !ok {
+		secret = &FileSecret{ID: secretID}
+		f.secrets[secretID] = secret
+	}
+	annotations := secret.Annotations
+	secret.Annotations = Annotations(f.config, &user)
+	number := 1
+	if len(secret.Versions) > 0 {
+		number = secret.Versions[len(secret.Versions)-1].Number + 1
+	}
+	secret.Versions = append(secret.Versions, FileVersion{Number: number, Created: time.Now().UTC(), Enabled: enabled, Payload: payload})
+	if err := f.save(); err != nil {
+		secret.Versions = secret.Versions[:len(secret.Versions)-1]
+		secret.Annotations = annotations
+		if !ok {
+			delete(f.secrets, secretID)
+		}
+		return "", err
+	}
+	return fileVersionName(secretID, number), nil
+}
+
+//SaveSecret adds a new current version to the secret of a user
+func (f *File) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	return f.addVersion(user, payload, true)
+}
+
+//StageSecret adds a disabled version to the secret of a user, LatestSecret keeps serving the previous one
+func (f *File) StageSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	return f.addVersion(user, payload, false)
+}
+
+//version finds a version by name, the caller holds mu
+func (f *File) version(name string) (*FileVersion, error) {
+	secretID, number, err := parseFileVersionName(name)
+	if err != nil {
+		return nil, err
+	}
+	if secret, ok := f.secrets[secretID]; ok {
+		for i := range secret.Versions {
+			if secret.Versions[i].Number == number && !secret.Versions[i].Destroyed {
+				return &secret.Versions[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("secret version %s not found in %s", name, f.path)
+}
+
+//EnableVersion makes a staged version current
+func (f *File) EnableVersion(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	version, err := f.version(name)
+	if err != nil {
+		return err
+	}
+	version.Enabled = true
+	if err := f.save(); err != nil {
+		version.Enabled = false
+		return err
+	}
+	return nil
+}
+
+//LatestSecret reads the newest enabled version of the secret of a user
+func (f *File) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	secretID, err := SecretID(f.config, user)
+	if err != nil {
+		return "", "", err
+	}
+	return f.Payload(secretID, 0)
+}
+
+//ListVersions lists the versions of the secret of a user newest first
+func (f *File) ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error) {
+	secretID, err := SecretID(f.config, user)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, ok := f.secrets[secretID]
+	if !ok {
+		return nil, nil
+	}
+	var versions []Version
+	for i := len(secret.Versions) - 1; i >= 0; i-- {
+		version := secret.Versions[i]
+		if version.Destroyed {
+			continue
+		}
+		versions = append(versions, Version{Name: fileVersionName(secretID, version.Number), Created: version.Created, Enabled: version.Enabled})
+	}
+	return versions, nil
+}
+
+//DestroyVersion removes the payload of a version, its number is not reused
+func (f *File) DestroyVersion(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	version, err := f.version(name)
+	if err != nil {
+		return err
+	}
+	previous := *version
+	version.Enabled, version.Destroyed, version.Payload = false, true, ""
+	if err := f.save(); err != nil {
+		*version = previous
+		return err
+	}
+	return nil
+}
+
+//DeleteSecret deletes the secret of a user with all its versions
+func (f *File) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	secretID, err := SecretID(f.config, user)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, ok := f.secrets[secretID]
+	if !ok {
+		return nil
+	}
+	delete(f.secrets, secretID)
+	if err := f.save(); err != nil {
+		f.secrets[secretID] = secret
+		return err
+	}
+	return nil
+}
+
+//Secrets lists the secrets of the file by id, for secrets_list
+func (f *File) Secrets() []FileSecret {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var secrets []FileSecret
+	for _, secret := range f.sortedSecrets() {
+		secrets = append(secrets, *secret)
+	}
+	return secrets
+}
+
+//Payload reads a version of a secret by id, the newest enabled one if number is 0
+func (f *File) Payload(secretID string, number int) (string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, ok := f.secrets[secretID]
+	if !ok {
+		return "", "", ErrNoSecretVersion
+	}
+	for i := len(secret.Versions) - 1; i >= 0; i-- {
+		version := secret.Versions[i]
+		if version.Destroyed {
+			continue
+		}
+		if (number == 0 && version.Enabled) || version.Number == number {
+			return fileVersionName(secretID, version.Number), version.Payload, nil
+		}
+	}
+	return "", "", ErrNoSecretVersion
+}
+
+//Close has nothing to release, every change is already written
+func (f *File) Close() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	configuration "mongo-util/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var fileTestUser = configuration.MongoUser{Username: "app", DBName: "admin", ProjectID: "5f1a2b3c4d5e6f7a8b9c0d1e", ProjectName: "zebra"}
+
+func fileTestConfig(path string) configuration.Config {
+	var config configuration.Config
+	config.SecretStore.Type = configuration.StoreFile
+	config.SecretStore.File = configuration.File{Path: path, Passphrase: "correct horse battery staple"}
+	return config
+}
+
+func TestFileFailedSaveIsRolledBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	ctx := context.Background()
+	store, err := NewFile(fileTestConfig(path))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	saved, err := store.SaveSecret(ctx, fileTestUser, "saved-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+
+	//the file can't be written in a missing directory
+	store.path = filepath.Join(t.TempDir(), "missing", "secrets.enc")
+	if _, err := store.SaveSecret(ctx, fileTestUser, "failed-password"); err == nil {
+		t.Fatalf("SaveSecret to a missing directory succeeded")
+	}
+	other := configuration.MongoUser{Username: "other", DBName: "admin", ProjectID: fileTestUser.ProjectID}
+	if _, err := store.StageSecret(ctx, other, "failed-password"); err == nil {
+		t.Fatalf("StageSecret to a missing directory succeeded")
+	}
+	if err := store.DestroyVersion(ctx, saved); err == nil {
+		t.Fatalf("DestroyVersion to a missing directory succeeded")
+	}
+	if err := store.DeleteSecret(ctx, fileTestUser); err == nil {
+		t.Fatalf("DeleteSecret to a missing directory succeeded")
+	}
+	if name, payload, err := store.LatestSecret(ctx, fileTestUser); err != nil || name != saved || payload != "saved-password" {
+		t.Fatalf("LatestSecret after failed saves returned %q %q %v", name, payload, err)
+	}
+	if secrets := store.Secrets(); len(secrets) != 1 || len(secrets[0].Versions) != 1 {
+		t.Fatalf("failed saves left %+v in memory", secrets)
+	}
+
+	//the next successful save doesn't persist the failed ones
+	store.path = path
+	next, err := store.SaveSecret(ctx, fileTestUser, "next-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	if want := "5f1a2b3c4d5e6f7a8b9c0d1e-app?version=2"; next != want {
+		t.Fatalf("SaveSecret returned %q, want %q", next, want)
+	}
+	reopened, err := NewFile(fileTestConfig(path))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	if secrets := reopened.Secrets(); len(secrets) != 1 || len(secrets[0].Versions) != 2 {
+		t.Fatalf("the file holds %+v, want the two saved versions of %s", secrets, fileTestUser.Username)
+	}
+}
+
+func TestFileCanBeMoved(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.enc")
+	ctx := context.Background()
+	store, err := NewFile(fileTestConfig(path))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	saved, err := store.SaveSecret(ctx, fileTestUser, "password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+
+	moved := filepath.Join(t.TempDir(), "copy.enc")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{moved, relative} {
+		reopened, err := NewFile(fileTestConfig(path))
+		if err != nil {
+			t.Fatalf("NewFile of the file moved to %s: %v", path, err)
+		}
+		if name, payload, err := reopened.LatestSecret(ctx, fileTestUser); err != nil || name != saved || payload != "password" {
+			t.Fatalf("LatestSecret of the file moved to %s returned %q %q %v", path, name, payload, err)
+		}
+	}
+
+	config := fileTestConfig(moved)
+	config.SecretStore.File.Passphrase = "wrong"
+	if _, err := NewFile(config); err != ErrWrongSecretsKey {
+		t.Fatalf("NewFile with a wrong passphrase: got %v, want ErrWrongSecretsKey", err)
+	}
+}
+
+func TestFileKeepsItsIterations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	ctx := context.Background()
+	store, err := NewFile(fileTestConfig(path))
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	//a file written with another iteration count, eg: by an older or newer release
+	store.iterations = 1000
+	store.key = deriveKey(store.secret, store.salt, store.iterations)
+	if _, err := store.SaveSecret(ctx, fileTestUser, "first-password"); err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+
+	reopened, err := NewFile(fileTestConfig(path))
+	if err != nil {
+		t.Fatalf("NewFile of a file with 1000 iterations: %v", err)
+	}
+	if reopened.iterations != 1000 {
+		t.Fatalf("the file is read with %d iterations, want 1000", reopened.iterations)
+	}
+	if _, err := reopened.SaveSecret(ctx, fileTestUser, "second-password"); err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope fileEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Iterations != 1000 || envelope.Format != fileFormat {
+		t.Fatalf("the file was saved again with format %d and %d iterations, want format %d and 1000", envelope.Format, envelope.Iterations, fileFormat)
+	}
+	again, err := NewFile(fileTestConfig(path))
+	if err != nil {
+		t.Fatalf("NewFile after a save: %v", err)
+	}
+	if _, payload, err := again.LatestSecret(ctx, fileTestUser); err != nil || payload != "second-password" {
+		t.Fatalf("LatestSecret returned %q %v", payload, err)
+	}
+}
@@ -0,0 +1,350 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	"strings"
+	"sync"
+)
+
+//Multi saves the secret of a user to every store its route names, the write counts only if every store accepts it.
+//The stores which already accepted a write are compensated when a later one fails, the first store of a route
+//is the one read back.
+type Multi struct {
+	stores map[string]Store
+	route  func(user configuration.MongoUser) []string
+
+	//staged keeps what EnableVersion needs to compensate, by version name
+	mu     sync.Mutex
+	staged map[string]stagedWrite
+}
+
+//stagedWrite is a version staged in every store of a user, with the secrets the stores served before
+type stagedWrite struct {
+	user     configuration.MongoUser
+	previous map[string]string
+}
+
+//stagedMulti is a Multi whose stores can all stage a version
+type stagedMulti struct {
+	*Multi
+}
+
+var (
+	_ Store  = (*Multi)(nil)
+	_ Pruner = (*Multi)(nil)
+	_ Stager = stagedMulti{}
+)
+
+//NewMulti fans out to stores by type, route gives the store types of a user. The returned store stages the
+//versions only if all the stores can, else every store gets the unstaged rotation.
+func NewMulti(stores map[string]Store, route func(user configuration.MongoUser) []string) Store {
+	multi := &Multi{stores: stores, route: route, staged: map[string]stagedWrite{}}
+	for _, store := range stores {
+		if _, ok := store.(Stager); !ok {
+			return multi
+		}
+	}
+	return stagedMulti{multi}
+}
+
+//destination is a store of a user with the version it got
+type destination struct {
+	storeType string
+	store     Store
+	version   string
+}
+
+func (m *Multi) destinations(user configuration.MongoUser) ([]destination, error) {
+	var destinations []destination
+	for _, storeType := range m.route(user) {
+		store, ok := m.stores[storeType]
+		if !ok {
+			return nil, fmt.Errorf("secret store %s is not open", storeType)
+		}
+		destinations = append(destinations, destination{storeType: storeType, store: store})
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("no secret store for %s", user.Username)
+	}
+	return destinations, nil
+}
+
+//multiVersion is the version a store got, in the version name of a Multi store
+type multiVersion struct {
+	Store   string `json:"store"`
+	Version string `json:"version"`
+}
+
+//multiVersionName names the versions of every store as a JSON array, the version names of the stores
+//can hold any character: [{"store":"<type>","version":"<version>"},..]
+func multiVersionName(destinations []destination) string {
+	var versions []multiVersion
+	for _, d := range destinations {
+		if d.version != "" {
+			versions = append(versions, multiVersion{Store: d.storeType, Version: d.version})
+		}
+	}
+	name, _ := json.Marshal(versions)
+	return string(name)
+}
+
+//IsMultiVersionName tells if a version name is the one of a Multi store
+func IsMultiVersionName(name string) bool {
+	return strings.HasPrefix(name, "[")
+}
+
+//parseMultiVersionName is the reverse of multiVersionName
+func (m *Multi) parseMultiVersionName(name string) ([]destination, error) {
+	var versions []multiVersion
+	if err := json.Unmarshal([]byte(name), &versions); err != nil || len(versions) == 0 {
+		return nil, fmt.Errorf("invalid secret version %q", name)
+	}
+	var destinations []destination
+	for _, version := range versions {
+		store, ok := m.stores[version.Store]
+		if !ok {
+			return nil, fmt.Errorf("secret store %s of version %q is not open", version.Store, name)
+		}
+		if version.Version == "" {
+			return nil, fmt.Errorf("invalid secret version %q", name)
+		}
+		destinations = append(destinations, destination{storeType: version.Store, store: store, version: version.Version})
+	}
+	return destinations, nil
+}
+
+//previousSecrets reads the current secret of every store of a user before it changes, nothing is kept for the
+//stores without one. An error is returned if a store can't be read, it could not be compensated.
+func previousSecrets(ctx context.Context, user configuration.MongoUser, destinations []destination) (map[string]string, error) {
+	previous := map[string]string{}
+	for _, d := range destinations {
+		_, payload, err := d.store.LatestSecret(ctx, user)
+		if err == ErrNoSecretVersion {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: reading previous secret: %v", d.storeType, err)
+		}
+		previous[d.storeType] = payload
+	}
+	return previous, nil
+}
+
+//compensate undoes the write of the given stores: the previous secret is saved again where the new version
+//is served, then the new version is destroyed if destroy is set, or the secret deleted if the write created it.
+//What can't be undone is logged and returned.
+func compensate(ctx context.Context, user configuration.MongoUser, done []destination, previous map[string]string, served, destroy bool) error {
+	var failures []string
+	for _, d := range done {
+		payload, hasPrevious := previous[d.storeType]
+		if hasPrevious && served {
+			if _, err := d.store.SaveSecret(ctx, user, payload); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: saving the previous secret again: %v", d.storeType, err))
+				continue
+			}
+		}
+		if !destroy {
+			continue
+		}
+		if !hasPrevious {
+			//the new version is the only one served, a store may refuse to destroy it (the AWSCURRENT version)
+			if err := d.store.DeleteSecret(ctx, user); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: deleting the new secret: %v", d.storeType, err))
+			}
+			continue
+		}
+		if err := d.store.DestroyVersion(ctx, d.version); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: destroying %s: %v", d.storeType, d.version, err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("compensation failed: %s", strings.Join(failures, "; "))
+	log.Printf("RECOVERY NEEDED: user %s of the DB %s: %v", user.Username, user.DBName, err)
+	return err
+}
+
+//write runs save on every store of a user in turn and compensates the stores which accepted it if one fails,
+//the previous secrets of the stores are returned with the version name
+func (m *Multi) write(ctx context.Context, user configuration.MongoUser, served bool,
+	save func(store Store) (string, error)) (string, map[string]string, error) {
+	destinations, err := m.destinations(user)
+	if err != nil {
+		return "", nil, err
+	}
+	previous, err := previousSecrets(ctx, user, destinations)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := range destinations {
+		version, err := save(destinations[i].store)
+		if err == nil {
+			destinations[i].version = version
+			continue
+		}
+		done := destinations[:i]
+		if version != "" {
+			//the version exists but the store failed to finish the write
+			destinations[i].version = version
+			done = destinations[:i+1]
+		}
+		err = fmt.Errorf("%s: %w", destinations[i].storeType, err)
+		if cErr := compensate(ctx, user, done, previous, served, true); cErr != nil {
+			return "", nil, fmt.Errorf("%w, %v", err, cErr)
+		}
+		return "", nil, err
+	}
+	return multiVersionName(destinations), previous, nil
+}
+
+//SaveSecret saves the secret of a user to all its stores, or to none of them
+func (m *Multi) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	name, _, err := m.write(ctx, user, true, func(store Store) (string, error) {
+		return store.SaveSecret(ctx, user, payload)
+	})
+	return name, err
+}
+
+//StageSecret stages the secret of a user in all its stores, or in none of them
+func (m stagedMulti) StageSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	name, previous, err := m.write(ctx, user, false, func(store Store) (string, error) {
+		return store.(Stager).StageSecret(ctx, user, payload)
+	})
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.staged[name] = stagedWrite{user: user, previous: previous}
+	m.mu.Unlock()
+	return name, nil
+}
+
+//EnableVersion enables the staged version of every store. If one fails, the stores already enabled get their
+//previous secret saved again so that they serve what the others serve, destroying the staged versions is left
+//to the caller like for a single store.
+func (m stagedMulti) EnableVersion(ctx context.Context, name string) error {
+	destinations, err := m.parseMultiVersionName(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	staged, known := m.staged[name]
+	delete(m.staged, name)
+	m.mu.Unlock()
+
+	for i, d := range destinations {
+		err := d.store.(Stager).EnableVersion(ctx, d.version)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s: %v", d.storeType, err)
+		if i == 0 {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("%v, the stores enabled before it serve the new secret", err)
+		}
+		if cErr := compensate(ctx, staged.user, destinations[:i], staged.previous, true, false); cErr != nil {
+			return fmt.Errorf("%v, %v", err, cErr)
+		}
+		return err
+	}
+	return nil
+}
+
+//LatestSecret reads the secret of a user from the first store of its route
+func (m *Multi) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	destinations, err := m.destinations(user)
+	if err != nil {
+		return "", "", err
+	}
+	return destinations[0].store.LatestSecret(ctx, user)
+}
+
+//ListVersions lists the versions of the secret of a user in the first store of its route
+func (m *Multi) ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error) {
+	destinations, err := m.destinations(user)
+	if err != nil {
+		return nil, err
+	}
+	return destinations[0].store.ListVersions(ctx, user)
+}
+
+//DestroyVersion destroys the version of every store, it goes on when one fails
+func (m *Multi) DestroyVersion(ctx context.Context, name string) error {
+	destinations, err := m.parseMultiVersionName(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.staged, name)
+	m.mu.Unlock()
+	var failures []string
+	for _, d := range destinations {
+		if err := d.store.DestroyVersion(ctx, d.version); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", d.storeType, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+//DeleteSecret deletes the secret of a user from every store of its route, it goes on when one fails
+func (m *Multi) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	destinations, err := m.destinations(user)
+	if err != nil {
+		return err
+	}
+	var failures []string
+	for _, d := range destinations {
+		if err := d.store.DeleteSecret(ctx, user); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", d.storeType, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+//Prune applies the retention to the stores of a user which can prune
+func (m *Multi) Prune(ctx context.Context, user configuration.MongoUser, retention configuration.Retention, dryRun bool) ([]PruneAction, error) {
+	destinations, err := m.destinations(user)
+	if err != nil {
+		return nil, err
+	}
+	var actions []PruneAction
+	for _, d := range destinations {
+		pruner, ok := d.store.(Pruner)
+		if !ok {
+			continue
+		}
+		pruned, err := pruner.Prune(ctx, user, retention, dryRun)
+		actions = append(actions, pruned...)
+		if err != nil {
+			return actions, fmt.Errorf("%s: %v", d.storeType, err)
+		}
+	}
+	return actions, nil
+}
+
+//Close closes every store
+func (m *Multi) Close() error {
+	var failures []string
+	for storeType, store := range m.stores {
+		if err := store.Close(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", storeType, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	configuration "mongo-util/config"
+	"strings"
+	"testing"
+)
+
+//memoryStore is a Store keeping the versions in memory, its version names hold the separators
+//other stores may use
+type memoryStore struct {
+	name     string
+	versions []memoryVersion
+	failSave bool
+	//refuseCurrent refuses to destroy the current version, like AWS does with AWSCURRENT
+	refuseCurrent bool
+}
+
+type memoryVersion struct {
+	name      string
+	payload   string
+	destroyed bool
+}
+
+func (s *memoryStore) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	if s.failSave {
+		return "", errors.New("save refused")
+	}
+	name := fmt.Sprintf("%s/%s;v=%d?x=[1]", s.name, user.Username, len(s.versions)+1)
+	s.versions = append(s.versions, memoryVersion{name: name, payload: payload})
+	return name, nil
+}
+
+func (s *memoryStore) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		if !s.versions[i].destroyed {
+			return s.versions[i].name, s.versions[i].payload, nil
+		}
+	}
+	return "", "", ErrNoSecretVersion
+}
+
+func (s *memoryStore) ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error) {
+	var versions []Version
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		if !s.versions[i].destroyed {
+			versions = append(versions, Version{Name: s.versions[i].name, Enabled: true})
+		}
+	}
+	return versions, nil
+}
+
+func (s *memoryStore) DestroyVersion(ctx context.Context, name string) error {
+	if current, _, err := s.LatestSecret(ctx, multiTestUser); s.refuseCurrent && err == nil && current == name {
+		return fmt.Errorf("version %q is current", name)
+	}
+	for i := range s.versions {
+		if s.versions[i].name == name && !s.versions[i].destroyed {
+			s.versions[i].destroyed = true
+			return nil
+		}
+	}
+	return fmt.Errorf("version %q not found", name)
+}
+
+func (s *memoryStore) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	s.versions = nil
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+var multiTestUser = configuration.MongoUser{Username: "app", DBName: "admin", ProjectID: "5f1a2b3c4d5e6f7a8b9c0d1e"}
+
+func TestMultiVersionNames(t *testing.T) {
+	first, second := &memoryStore{name: "first=a;b"}, &memoryStore{name: "second"}
+	multi := NewMulti(map[string]Store{"vault": first, "azure": second}, func(user configuration.MongoUser) []string {
+		return []string{"vault", "azure"}
+	})
+	ctx := context.Background()
+
+	name, err := multi.SaveSecret(ctx, multiTestUser, "password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	if !IsMultiVersionName(name) {
+		t.Fatalf("%q is not a Multi version name", name)
+	}
+	destinations, err := multi.(*Multi).parseMultiVersionName(name)
+	if err != nil {
+		t.Fatalf("parseMultiVersionName(%q): %v", name, err)
+	}
+	if len(destinations) != 2 || destinations[0].storeType != "vault" || destinations[0].version != first.versions[0].name ||
+		destinations[1].storeType != "azure" || destinations[1].version != second.versions[0].name {
+		t.Fatalf("parseMultiVersionName(%q) returned %+v", name, destinations)
+	}
+
+	if err := multi.DestroyVersion(ctx, name); err != nil {
+		t.Fatalf("DestroyVersion: %v", err)
+	}
+	if !first.versions[0].destroyed || !second.versions[0].destroyed {
+		t.Fatalf("DestroyVersion left a version of a store")
+	}
+
+	for _, invalid := range []string{"", "[]", "vault=1;azure=2", `[{"store":"gcp","version":"1"}]`, `[{"store":"vault","version":""}]`} {
+		if _, err := multi.(*Multi).parseMultiVersionName(invalid); err == nil {
+			t.Errorf("parseMultiVersionName(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestMultiCompensation(t *testing.T) {
+	first, second := &memoryStore{name: "first"}, &memoryStore{name: "second"}
+	multi := NewMulti(map[string]Store{"vault": first, "azure": second}, func(user configuration.MongoUser) []string {
+		return []string{"vault", "azure"}
+	})
+	ctx := context.Background()
+	if _, err := multi.SaveSecret(ctx, multiTestUser, "previous"); err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+
+	second.failSave = true
+	if _, err := multi.SaveSecret(ctx, multiTestUser, "new"); err == nil {
+		t.Fatalf("SaveSecret succeeded with a failing store")
+	}
+	//the first store got the new secret, then the previous one again, and the new version is destroyed
+	if _, payload, err := first.LatestSecret(ctx, multiTestUser); err != nil || payload != "previous" {
+		t.Fatalf("the first store serves %q %v after the compensation, want previous", payload, err)
+	}
+	if len(first.versions) != 3 || !first.versions[1].destroyed || first.versions[1].payload != "new" {
+		t.Fatalf("the new version of the first store is not destroyed: %+v", first.versions)
+	}
+}
+
+func TestMultiCompensationOfANewSecret(t *testing.T) {
+	first, second := &memoryStore{name: "first", refuseCurrent: true}, &memoryStore{name: "second", failSave: true}
+	multi := NewMulti(map[string]Store{"aws": first, "azure": second}, func(user configuration.MongoUser) []string {
+		return []string{"aws", "azure"}
+	})
+	ctx := context.Background()
+
+	_, err := multi.SaveSecret(ctx, multiTestUser, "new")
+	if err == nil {
+		t.Fatalf("SaveSecret succeeded with a failing store")
+	}
+	if strings.Contains(err.Error(), "compensation failed") {
+		t.Fatalf("the new secret of the first store is not compensated: %v", err)
+	}
+	//the user had no secret, the one created by the failed write is deleted
+	if _, _, err := first.LatestSecret(ctx, multiTestUser); err != ErrNoSecretVersion {
+		t.Fatalf("the first store serves a secret Atlas never got: %v", err)
+	}
+}
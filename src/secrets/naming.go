@@ -0,0 +1,135 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	configuration "mongo-util/config"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//DefaultSecretNameTemplate keeps the historical <ProjectID>-<Username> secret ids
+const DefaultSecretNameTemplate = "{{.ProjectID}}-{{.Username}}"
+
+var (
+	//secretIDPattern is the Secret Manager naming rule of secret ids
+	secretIDPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]{1,255}$`)
+	invalidSecretChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+//secretNameData are the fields a secret name template can use
+type secretNameData struct {
+	ProjectID   string
+	ProjectName string
+	DBName      string
+	Username    string
+}
+
+//sanitize replaces the characters Secret Manager rejects in secret ids, usable in templates as {{sanitize .DBName}}.
+//Distinct values can give the same id, eg: a.b and a_b, the users are checked for that before a rotation.
+func sanitize(value string) string {
+	return invalidSecretChars.ReplaceAllString(value, "_")
+}
+
+//secretNameTemplates are the parsed gcp.secret_name_template by text, a template is parsed once per run
+var secretNameTemplates sync.Map
+
+func secretNameTemplate(config configuration.Config) (*template.Template, error) {
+	text := config.GCP.SecretNameTemplate
+	if text == "" {
+		text = DefaultSecretNameTemplate
+	}
+	if tmpl, ok := secretNameTemplates.Load(text); ok {
+		return tmpl.(*template.Template), nil
+	}
+	tmpl, err := template.New("secret_name_template").Option("missingkey=error").
+		Funcs(template.FuncMap{"sanitize": sanitize, "lower": strings.ToLower}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gcp.secret_name_template: %v", err)
+	}
+	secretNameTemplates.Store(text, tmpl)
+	return tmpl, nil
+}
+
+//ValidateSecretNameTemplate checks gcp.secret_name_template parses and renders a valid secret id
+func ValidateSecretNameTemplate(config configuration.Config) error {
+	_, err := SecretID(config, configuration.MongoUser{
+		Username:    "user",
+		DBName:      "admin",
+		ProjectID:   "000000000000000000000000",
+		ProjectName: "project",
+	})
+	return err
+}
+
+//SecretID is the id under which the password of a given user is saved in every store,
+//rendered from gcp.secret_name_template and checked against the Secret Manager naming rules, the strictest of the stores
+func SecretID(config configuration.Config, user configuration.MongoUser) (string, error) {
+	tmpl, err := secretNameTemplate(config)
+	if err != nil {
+		return "", err
+	}
+	data := secretNameData{
+		ProjectID:   user.ProjectID,
+		ProjectName: ProjectName(config, user),
+		DBName:      user.DBName,
+		Username:    user.Username,
+	}
+	var id bytes.Buffer
+	if err := tmpl.Execute(&id, data); err != nil {
+		return "", fmt.Errorf("invalid gcp.secret_name_template: %v", err)
+	}
+	if !secretIDPattern.MatchString(id.String()) {
+		return "", fmt.Errorf("secret id %q of the user %s is invalid, only letters, digits, _ and - are allowed (1 to 255 characters), "+
+			"use {{sanitize .Field}} in gcp.secret_name_template", id.String(), user.Username)
+	}
+	return id.String(), nil
+}
+
+//ValidSecretID checks a secret id which isn't rendered from the template
+func ValidSecretID(secretID string) error {
+	if !secretIDPattern.MatchString(secretID) {
+		return fmt.Errorf("secret id %q is invalid, only letters, digits, _ and - are allowed", secretID)
+	}
+	return nil
+}
+
+//ProjectName is the project name of a user, the db users API doesn't return it
+func ProjectName(config configuration.Config, user configuration.MongoUser) string {
+	if user.ProjectName != "" {
+		return user.ProjectName
+	}
+	return config.Mongo.ProjectName
+}
+
+//RotatedBy is who runs the tool: the Jenkins build, else the OS user
+func RotatedBy() string {
+	for _, env := range []string{"BUILD_TAG", "USER"} {
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+	}
+	return "mongo-util"
+}
+
+//Annotations describe who rotated the secret of a user and when, stores set them as metadata or tags.
+//user is nil for the secrets which don't belong to a db user.
+func Annotations(config configuration.Config, user *configuration.MongoUser) map[string]string {
+	annotations := map[string]string{
+		"mongo-util.rotated-by": RotatedBy(),
+		"mongo-util.rotated-at": time.Now().UTC().Format(time.RFC3339),
+	}
+	if config.GCP.Env != "" {
+		annotations["mongo-util.env"] = config.GCP.Env
+	}
+	if user != nil {
+		annotations["mongo-util.project"] = ProjectName(config, *user)
+		annotations["mongo-util.username"] = user.Username
+		annotations["mongo-util.database"] = user.DBName
+	}
+	return annotations
+}
@@ -0,0 +1,89 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	configuration "mongo-util/config"
+	"time"
+)
+
+//ErrNoSecretVersion is returned when a secret has no enabled version to read
+var ErrNoSecretVersion = errors.New("no enabled secret version found")
+
+//ErrSecretMismatch is returned when a saved version doesn't hold the payload that was written
+var ErrSecretMismatch = errors.New("secret integrity check failed")
+
+//Version is a version of the secret of a user, Name identifies it in its store
+type Version struct {
+	Name    string
+	Created time.Time
+	Enabled bool
+}
+
+//Store saves the credentials of the db users, a secret per user with a version per rotation.
+//A store is shared by the workers of a run and must be safe for concurrent use.
+type Store interface {
+	//SaveSecret adds a new current version to the secret of a user, the secret is created if missing.
+	//The name of the new version is returned.
+	SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error)
+	//LatestSecret reads the name and payload of the current version of the secret of a user,
+	//ErrNoSecretVersion is returned if there is none
+	LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error)
+	//ListVersions lists the versions of the secret of a user newest first, destroyed versions are left out
+	ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error)
+	//DestroyVersion irreversibly destroys a version returned by SaveSecret
+	DestroyVersion(ctx context.Context, name string) error
+	//DeleteSecret deletes the secret of a user with all its versions
+	DeleteSecret(ctx context.Context, user configuration.MongoUser) error
+	Close() error
+}
+
+//Stager is implemented by the stores which can save a version without serving it, so that a password
+//only becomes current once Atlas has it. Other stores get the new password saved as current before Atlas is updated
+//and the previous one saved again if the rotation fails.
+type Stager interface {
+	//StageSecret adds a new version to the secret of a user which is not served until EnableVersion is called
+	StageSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error)
+	//EnableVersion makes a staged version the current one
+	EnableVersion(ctx context.Context, name string) error
+}
+
+//IDSaver is implemented by the stores which can save a secret that doesn't belong to a db user,
+//eg: the Atlas API key rotated by rotate_api_keys
+type IDSaver interface {
+	//SaveSecretByID adds a new current version to the secret with the given id, the name of the version is returned
+	SaveSecretByID(ctx context.Context, secretID string, payload string) (string, error)
+}
+
+//Actions of the retention policy on a secret version
+const (
+	PruneDisable = "disable"
+	PruneDestroy = "destroy"
+)
+
+//PruneAction is a change the retention policy makes to a secret version
+type PruneAction struct {
+	Version string
+	Action  string
+	Created time.Time
+}
+
+//Pruner is implemented by the stores which apply gcp.retention to the versions of the secrets
+type Pruner interface {
+	Prune(ctx context.Context, user configuration.MongoUser, retention configuration.Retention, dryRun bool) ([]PruneAction, error)
+}
+
+//LatestVersionTime is the creation time of the current version of the secret of a user,
+//ErrNoSecretVersion is returned if there is none
+func LatestVersionTime(ctx context.Context, store Store, user configuration.MongoUser) (time.Time, error) {
+	versions, err := store.ListVersions(ctx, user)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, version := range versions {
+		if version.Enabled {
+			return version.Created, nil
+		}
+	}
+	return time.Time{}, ErrNoSecretVersion
+}
@@ -0,0 +1,354 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	configuration "mongo-util/config"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//vaultValueKey holds the payloads which are not a JSON object, KV v2 only stores objects
+	vaultValueKey = "value"
+	//vaultPayloadKey keeps a JSON payload as it was written next to its fields, Vault returns the fields
+	//in another order and a map can't keep it
+	vaultPayloadKey = "mongo-util.payload"
+)
+
+//Vault saves the secrets in a HashiCorp Vault KV v2 secrets engine, every save is a new KV version
+type Vault struct {
+	config configuration.Config
+	vault  configuration.Vault
+	token  string
+	client *http.Client
+}
+
+var _ Store = (*Vault)(nil)
+
+//VaultError is returned when Vault answers with an unexpected status
+type VaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *VaultError) Error() string {
+	return fmt.Sprintf("vault returned %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+//NewVault connects to Vault and logs in with AppRole when it is configured
+func NewVault(ctx context.Context, config configuration.Config) (*Vault, error) {
+	vault := config.SecretStore.Vault
+	if vault.Address == "" {
+		vault.Address = os.Getenv("VAULT_ADDR")
+	}
+	if vault.Address == "" {
+		return nil, fmt.Errorf("secret_store.vault.address or VAULT_ADDR is required")
+	}
+	vault.Address = strings.TrimSuffix(vault.Address, "/")
+	if vault.Namespace == "" {
+		vault.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if vault.Mount == "" {
+		vault.Mount = "secret"
+	}
+
+	v := &Vault{config: config, vault: vault, client: &http.Client{Timeout: 30 * time.Second}}
+	if vault.AppRole.RoleID != "" {
+		if err := v.login(ctx); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	v.token = vault.Token
+	if v.token == "" {
+		v.token = os.Getenv("VAULT_TOKEN")
+	}
+	if v.token == "" {
+		return nil, fmt.Errorf("secret_store.vault.token, VAULT_TOKEN or secret_store.vault.approle is required")
+	}
+	return v, nil
+}
+
+//login gets a token from the approle auth method
+func (v *Vault) login(ctx context.Context) error {
+	appRole := v.vault.AppRole
+	if appRole.Mount == "" {
+		appRole.Mount = "approle"
+	}
+	if appRole.SecretID == "" {
+		appRole.SecretID = os.Getenv("VAULT_SECRET_ID")
+	}
+	var response struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	payload := map[string]string{"role_id": appRole.RoleID, "secret_id": appRole.SecretID}
+	if _, err := v.call(ctx, http.MethodPost, fmt.Sprintf("auth/%s/login", appRole.Mount), payload, &response); err != nil {
+		return fmt.Errorf("vault approle login: %v", err)
+	}
+	if response.Auth.ClientToken == "" {
+		return fmt.Errorf("vault approle login returned no token")
+	}
+	v.token = response.Auth.ClientToken
+	return nil
+}
+
+//call sends a request to the Vault API and decodes the response into out, 404 is returned
+//as a VaultError for the callers to tell a missing secret
+func (v *Vault) call(ctx context.Context, method, apiPath string, payload, out interface{}) (int, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.vault.Address+"/v1/"+apiPath, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if v.vault.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.vault.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		vaultErr := &VaultError{StatusCode: resp.StatusCode}
+		var errBody struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &errBody) == nil {
+			vaultErr.Errors = errBody.Errors
+		}
+		return resp.StatusCode, vaultErr
+	}
+	if out != nil && len(data) > 0 {
+		//numbers of the secret data are kept as written, not turned into float64
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decode vault response: %v", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+//VaultSecretName is the path of the secret of a user, <mount>/<path_prefix>/<secret id>
+func VaultSecretName(config configuration.Config, user configuration.MongoUser) (string, error) {
+	secretPath, err := vaultPath(config.SecretStore.Vault, config, user)
+	if err != nil {
+		return "", err
+	}
+	mount := config.SecretStore.Vault.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	return mount + "/" + secretPath, nil
+}
+
+func vaultPath(vault configuration.Vault, config configuration.Config, user configuration.MongoUser) (string, error) {
+	secretID, err := SecretID(config, user)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(vault.PathPrefix, secretID), nil
+}
+
+//versionName names a KV version like the vault CLI reads it: <mount>/<path>?version=<n>
+func (v *Vault) versionName(secretPath string, version int) string {
+	return fmt.Sprintf("%s/%s?version=%d", v.vault.Mount, secretPath, version)
+}
+
+//parseVersionName is the reverse of versionName
+func (v *Vault) parseVersionName(name string) (string, int, error) {
+	parts := strings.SplitN(strings.TrimPrefix(name, v.vault.Mount+"/"), "?version=", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid vault version %q", name)
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid vault version %q", name)
+	}
+	return parts[0], version, nil
+}
+
+//vaultData is the KV data of a payload: the fields of a JSON object with the payload itself under
+//"mongo-util.payload", or the payload under "value"
+func vaultData(payload string) map[string]interface{} {
+	var data map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err == nil && data != nil && !decoder.More() {
+		data[vaultPayloadKey] = payload
+		return data
+	}
+	return map[string]interface{}{vaultValueKey: payload}
+}
+
+//vaultPayload is the reverse of vaultData, the versions written without "mongo-util.payload" are encoded
+//from their fields
+func vaultPayload(data map[string]interface{}) (string, error) {
+	if payload, ok := data[vaultPayloadKey].(string); ok {
+		return payload, nil
+	}
+	if value, ok := data[vaultValueKey].(string); ok && len(data) == 1 {
+		return value, nil
+	}
+	payload, err := json.Marshal(data)
+	return string(payload), err
+}
+
+//SaveSecret writes a new KV version of the secret of a user, the annotations are set as custom metadata
+func (v *Vault) SaveSecret(ctx context.Context, user configuration.MongoUser, payload string) (string, error) {
+	secretPath, err := vaultPath(v.vault, v.config, user)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"data": vaultData(payload)}
+	if _, err := v.call(ctx, http.MethodPost, v.vault.Mount+"/data/"+secretPath, body, &response); err != nil {
+		return "", fmt.Errorf("failed to write vault secret %s: %v", secretPath, err)
+	}
+	name := v.versionName(secretPath, response.Data.Version)
+
+	//the version is saved, missing metadata must not fail the rotation
+	metadata := map[string]interface{}{"custom_metadata": Annotations(v.config, &user)}
+	if _, err := v.call(ctx, http.MethodPost, v.vault.Mount+"/metadata/"+secretPath, metadata, nil); err != nil {
+		log.Printf("WARNING: unable to set the metadata of vault secret %s: %v", secretPath, err)
+	}
+	return name, nil
+}
+
+//LatestSecret reads the current KV version of the secret of a user
+func (v *Vault) LatestSecret(ctx context.Context, user configuration.MongoUser) (string, string, error) {
+	secretPath, err := vaultPath(v.vault, v.config, user)
+	if err != nil {
+		return "", "", err
+	}
+	var response struct {
+		Data struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	status, err := v.call(ctx, http.MethodGet, v.vault.Mount+"/data/"+secretPath, nil, &response)
+	if status == http.StatusNotFound {
+		return "", "", ErrNoSecretVersion
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read vault secret %s: %v", secretPath, err)
+	}
+	//the current version is deleted or destroyed
+	if response.Data.Data == nil {
+		return "", "", ErrNoSecretVersion
+	}
+	payload, err := vaultPayload(response.Data.Data)
+	if err != nil {
+		return "", "", err
+	}
+	return v.versionName(secretPath, response.Data.Metadata.Version), payload, nil
+}
+
+//ListVersions lists the KV versions of the secret of a user newest first, deleted versions are disabled ones
+func (v *Vault) ListVersions(ctx context.Context, user configuration.MongoUser) ([]Version, error) {
+	secretPath, err := vaultPath(v.vault, v.config, user)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Data struct {
+			Versions map[string]struct {
+				CreatedTime  time.Time `json:"created_time"`
+				DeletionTime string    `json:"deletion_time"`
+				Destroyed    bool      `json:"destroyed"`
+			} `json:"versions"`
+		} `json:"data"`
+	}
+	status, err := v.call(ctx, http.MethodGet, v.vault.Mount+"/metadata/"+secretPath, nil, &response)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of vault secret %s: %v", secretPath, err)
+	}
+
+	var numbers []int
+	for key, version := range response.Data.Versions {
+		number, err := strconv.Atoi(key)
+		if err != nil || version.Destroyed {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	var versions []Version
+	for _, number := range numbers {
+		version := response.Data.Versions[strconv.Itoa(number)]
+		versions = append(versions, Version{
+			Name:    v.versionName(secretPath, number),
+			Created: version.CreatedTime,
+			Enabled: version.DeletionTime == "",
+		})
+	}
+	return versions, nil
+}
+
+//DestroyVersion permanently removes the data of a KV version
+func (v *Vault) DestroyVersion(ctx context.Context, name string) error {
+	secretPath, version, err := v.parseVersionName(name)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{"versions": []int{version}}
+	if _, err := v.call(ctx, http.MethodPost, v.vault.Mount+"/destroy/"+secretPath, body, nil); err != nil {
+		return fmt.Errorf("failed to destroy vault secret version %s: %v", name, err)
+	}
+	return nil
+}
+
+//DeleteSecret deletes the metadata and all the versions of the secret of a user
+func (v *Vault) DeleteSecret(ctx context.Context, user configuration.MongoUser) error {
+	secretPath, err := vaultPath(v.vault, v.config, user)
+	if err != nil {
+		return err
+	}
+	status, err := v.call(ctx, http.MethodDelete, v.vault.Mount+"/metadata/"+secretPath, nil, nil)
+	if err != nil && status != http.StatusNotFound {
+		return fmt.Errorf("failed to delete vault secret %s: %v", secretPath, err)
+	}
+	return nil
+}
+
+//Close has nothing to release, the token expires on its own
+func (v *Vault) Close() error {
+	return nil
+}
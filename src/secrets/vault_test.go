@@ -0,0 +1,280 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	configuration "mongo-util/config"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//fakeVaultVersion is a KV v2 version of the fake Vault
+type fakeVaultVersion struct {
+	data      map[string]interface{}
+	created   time.Time
+	destroyed bool
+}
+
+//fakeVault is a KV v2 engine mounted at secret/ with the approle auth method
+type fakeVault struct {
+	secrets  map[string][]*fakeVaultVersion
+	metadata map[string]map[string]string
+	logins   int
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, string) {
+	fake := &fakeVault{secrets: map[string][]*fakeVaultVersion{}, metadata: map[string]map[string]string{}}
+	_, address := newFakeServer(t, "application/json", fake.handle)
+	return fake, address
+}
+
+func vaultErrors(errors ...string) map[string][]string {
+	return map[string][]string{"errors": errors}
+}
+
+func (f *fakeVault) handle(call fakeCall) (int, interface{}) {
+	if call.path == "/v1/auth/approle/login" {
+		if call.body["role_id"] != "role" || call.body["secret_id"] != "secret" {
+			return http.StatusBadRequest, vaultErrors("invalid role or secret ID")
+		}
+		f.logins++
+		return http.StatusOK, map[string]interface{}{"auth": map[string]string{"client_token": "approle-token"}}
+	}
+	if token := call.header.Get("X-Vault-Token"); token != "root-token" && !(f.logins > 0 && token == "approle-token") {
+		return http.StatusForbidden, vaultErrors("permission denied")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(call.path, "/v1/secret/"), "/", 2)
+	if len(parts) != 2 {
+		return http.StatusNotFound, vaultErrors()
+	}
+	kind, secretPath := parts[0], parts[1]
+	versions := f.secrets[secretPath]
+	switch kind + " " + call.method {
+	case "data POST":
+		data, _ := call.body["data"].(map[string]interface{})
+		f.secrets[secretPath] = append(versions, &fakeVaultVersion{data: data, created: time.Now()})
+		return http.StatusOK, map[string]interface{}{"data": map[string]int{"version": len(versions) + 1}}
+	case "data GET":
+		if len(versions) == 0 {
+			return http.StatusNotFound, vaultErrors()
+		}
+		latest := versions[len(versions)-1]
+		var data map[string]interface{}
+		if !latest.destroyed {
+			data = latest.data
+		}
+		return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data":     data,
+			"metadata": map[string]interface{}{"version": len(versions), "destroyed": latest.destroyed},
+		}}
+	case "metadata POST":
+		metadata := map[string]string{}
+		custom, _ := call.body["custom_metadata"].(map[string]interface{})
+		for key, value := range custom {
+			metadata[key], _ = value.(string)
+		}
+		f.metadata[secretPath] = metadata
+		return http.StatusNoContent, nil
+	case "metadata GET":
+		if len(versions) == 0 {
+			return http.StatusNotFound, vaultErrors()
+		}
+		listed := map[string]interface{}{}
+		for i, version := range versions {
+			listed[strconv.Itoa(i+1)] = map[string]interface{}{
+				"created_time": version.created.Format(time.RFC3339Nano),
+				"destroyed":    version.destroyed,
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"versions": listed}}
+	case "metadata DELETE":
+		delete(f.secrets, secretPath)
+		delete(f.metadata, secretPath)
+		return http.StatusNoContent, nil
+	case "destroy POST":
+		numbers, _ := call.body["versions"].([]interface{})
+		for _, number := range numbers {
+			versions[int(number.(float64))-1].destroyed = true
+		}
+		return http.StatusNoContent, nil
+	}
+	return http.StatusMethodNotAllowed, vaultErrors("unsupported " + call.method + " " + call.path)
+}
+
+func vaultTestConfig(address string) configuration.Config {
+	var config configuration.Config
+	config.SecretStore.Type = configuration.StoreVault
+	config.SecretStore.Vault = configuration.Vault{Address: address + "/", PathPrefix: "mongo", Token: "root-token"}
+	return config
+}
+
+var vaultTestUser = configuration.MongoUser{Username: "app", DBName: "admin", ProjectID: "5f1a2b3c4d5e6f7a8b9c0d1e", ProjectName: "zebra"}
+
+func TestVaultTokenRoundTrip(t *testing.T) {
+	fake, address := newFakeVault(t)
+	ctx := context.Background()
+	vault, err := NewVault(ctx, vaultTestConfig(address))
+	if err != nil {
+		t.Fatalf("NewVault: %v", err)
+	}
+	defer vault.Close()
+
+	if _, _, err := vault.LatestSecret(ctx, vaultTestUser); err != ErrNoSecretVersion {
+		t.Fatalf("LatestSecret of a missing secret: got %v, want ErrNoSecretVersion", err)
+	}
+	if versions, err := vault.ListVersions(ctx, vaultTestUser); err != nil || len(versions) != 0 {
+		t.Fatalf("ListVersions of a missing secret: got %v, %v", versions, err)
+	}
+
+	first, err := vault.SaveSecret(ctx, vaultTestUser, "first-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	if want := "secret/mongo/5f1a2b3c4d5e6f7a8b9c0d1e-app?version=1"; first != want {
+		t.Fatalf("SaveSecret returned %q, want %q", first, want)
+	}
+	second, err := vault.SaveSecret(ctx, vaultTestUser, "second-password")
+	if err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	if got := fake.metadata["mongo/5f1a2b3c4d5e6f7a8b9c0d1e-app"]["mongo-util.username"]; got != "app" {
+		t.Errorf("custom metadata username is %q, want app", got)
+	}
+
+	name, payload, err := vault.LatestSecret(ctx, vaultTestUser)
+	if err != nil {
+		t.Fatalf("LatestSecret: %v", err)
+	}
+	if name != second || payload != "second-password" {
+		t.Fatalf("LatestSecret returned %q %q, want %q second-password", name, payload, second)
+	}
+
+	versions, err := vault.ListVersions(ctx, vaultTestUser)
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Name != second || versions[1].Name != first || !versions[0].Enabled {
+		t.Fatalf("ListVersions returned %+v, want %s then %s", versions, second, first)
+	}
+
+	if err := vault.DestroyVersion(ctx, first); err != nil {
+		t.Fatalf("DestroyVersion: %v", err)
+	}
+	if versions, err = vault.ListVersions(ctx, vaultTestUser); err != nil || len(versions) != 1 || versions[0].Name != second {
+		t.Fatalf("ListVersions after DestroyVersion returned %+v, %v", versions, err)
+	}
+	if err := vault.DestroyVersion(ctx, second); err != nil {
+		t.Fatalf("DestroyVersion: %v", err)
+	}
+	if _, _, err := vault.LatestSecret(ctx, vaultTestUser); err != ErrNoSecretVersion {
+		t.Fatalf("LatestSecret of a destroyed version: got %v, want ErrNoSecretVersion", err)
+	}
+
+	if err := vault.DeleteSecret(ctx, vaultTestUser); err != nil {
+		t.Fatalf("DeleteSecret: %v", err)
+	}
+	if _, ok := fake.secrets["mongo/5f1a2b3c4d5e6f7a8b9c0d1e-app"]; ok {
+		t.Fatalf("DeleteSecret left the secret in vault")
+	}
+	if err := vault.DeleteSecret(ctx, vaultTestUser); err != nil {
+		t.Fatalf("DeleteSecret of a missing secret: %v", err)
+	}
+}
+
+func TestVaultAppRoleLogin(t *testing.T) {
+	fake, address := newFakeVault(t)
+	ctx := context.Background()
+	config := vaultTestConfig(address)
+	config.SecretStore.Vault.Token = ""
+	config.SecretStore.Vault.AppRole = configuration.AppRole{RoleID: "role", SecretID: "secret"}
+
+	vault, err := NewVault(ctx, config)
+	if err != nil {
+		t.Fatalf("NewVault with approle: %v", err)
+	}
+	if fake.logins != 1 || vault.token != "approle-token" {
+		t.Fatalf("approle login: %d logins, token %q", fake.logins, vault.token)
+	}
+	if _, err := vault.SaveSecret(ctx, vaultTestUser, "password"); err != nil {
+		t.Fatalf("SaveSecret with the approle token: %v", err)
+	}
+
+	config.SecretStore.Vault.AppRole.SecretID = "wrong"
+	if _, err := NewVault(ctx, config); err == nil {
+		t.Fatalf("NewVault with a wrong secret_id succeeded")
+	}
+}
+
+func TestVaultWrongToken(t *testing.T) {
+	_, address := newFakeVault(t)
+	ctx := context.Background()
+	config := vaultTestConfig(address)
+	config.SecretStore.Vault.Token = "wrong"
+	vault, err := NewVault(ctx, config)
+	if err != nil {
+		t.Fatalf("NewVault: %v", err)
+	}
+	_, _, err = vault.LatestSecret(ctx, vaultTestUser)
+	if err == nil || err == ErrNoSecretVersion {
+		t.Fatalf("LatestSecret with a wrong token: got %v, want a permission error", err)
+	}
+}
+
+func TestVaultJSONPayload(t *testing.T) {
+	_, address := newFakeVault(t)
+	ctx := context.Background()
+	vault, err := NewVault(ctx, vaultTestConfig(address))
+	if err != nil {
+		t.Fatalf("NewVault: %v", err)
+	}
+	payload := `{"username":"app","password":"p@ss","port":27017,"ratio":0.5,"hosts":["a","b"]}`
+	if _, err := vault.SaveSecret(ctx, vaultTestUser, payload); err != nil {
+		t.Fatalf("SaveSecret: %v", err)
+	}
+	_, read, err := vault.LatestSecret(ctx, vaultTestUser)
+	if err != nil {
+		t.Fatalf("LatestSecret: %v", err)
+	}
+	if read != payload {
+		t.Fatalf("JSON payload changed in vault:\n got %s\nwant %s", read, payload)
+	}
+}
+
+func TestVaultData(t *testing.T) {
+	for _, payload := range []string{
+		"plain-password",
+		`{"password":"p","port":27017,"big":12345678901234567890}`,
+		`{"b":1, "a":{"z":true,"y":null}}`,
+		`["not","an","object"]`,
+		`{"a":1} trailing`,
+	} {
+		//the data goes through JSON like it does through Vault
+		encoded, err := json.Marshal(vaultData(payload))
+		if err != nil {
+			t.Fatalf("marshal vaultData(%q): %v", payload, err)
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(encoded, &data); err != nil {
+			t.Fatalf("unmarshal vaultData(%q): %v", payload, err)
+		}
+		read, err := vaultPayload(data)
+		if err != nil {
+			t.Fatalf("vaultPayload(%q): %v", payload, err)
+		}
+		if read != payload {
+			t.Errorf("round trip of %q returned %q", payload, read)
+		}
+	}
+
+	data := vaultData(`{"password":"p","port":27017}`)
+	if data["password"] != "p" || data["port"] != json.Number("27017") {
+		t.Errorf("vaultData doesn't keep the fields of a JSON payload: %v", data)
+	}
+	if got, _ := vaultPayload(map[string]interface{}{vaultValueKey: "legacy"}); got != "legacy" {
+		t.Errorf("vaultPayload of a bare password returned %q", got)
+	}
+}
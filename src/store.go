@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	configuration "mongo-util/config"
+	gcp "mongo-util/gcp"
+	secrets "mongo-util/secrets"
+	"regexp"
+	"strings"
+)
+
+//storeType is the secret_store of the project in rotation.projects, secret_store.type if it has none
+func storeType() string {
+	if project, ok := config.Rotation.Projects[config.Mongo.ProjectName]; ok && project.SecretStore != "" {
+		return project.SecretStore
+	}
+	if config.SecretStore.Type == "" {
+		return configuration.StoreGCP
+	}
+	return config.SecretStore.Type
+}
+
+//validStoreRoutes checks secret_store.routes of config.json
+func validStoreRoutes() error {
+	for i, route := range config.SecretStore.Routes {
+		if len(route.Stores) == 0 {
+			return fmt.Errorf("secret_store.routes[%d]: stores is required", i)
+		}
+		for _, pattern := range []string{route.Users, route.Databases} {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("secret_store.routes[%d]: %v", i, err)
+			}
+		}
+		seen := map[string]bool{}
+		for _, storeType := range route.Stores {
+			if err := configuration.ValidStoreType(storeType); err != nil {
+				return fmt.Errorf("secret_store.routes[%d]: %v", i, err)
+			}
+			if seen[storeType] {
+				return fmt.Errorf("secret_store.routes[%d]: store %s is listed twice", i, storeType)
+			}
+			seen[storeType] = true
+		}
+	}
+	return nil
+}
+
+//routeStores are the store types the secret of a user is saved to: the ones of its route, else the one of the project
+func routeStores(user configuration.MongoUser) []string {
+	for _, route := range config.SecretStore.Routes {
+		if route.Project != "" && route.Project != secrets.ProjectName(config, user) {
+			continue
+		}
+		//the patterns are checked by validStoreRoutes
+		if matched, _ := regexp.MatchString(route.Users, user.Username); !matched {
+			continue
+		}
+		if matched, _ := regexp.MatchString(route.Databases, user.DBName); !matched {
+			continue
+		}
+		return route.Stores
+	}
+	return []string{storeType()}
+}
+
+//openSecretStore connects to the store selected for the project, or to all the stores of secret_store.routes
+//and the one of the project when routes are set
+func openSecretStore(ctx context.Context) (secrets.Store, error) {
+	if len(config.SecretStore.Routes) == 0 {
+		return openStore(ctx, storeType())
+	}
+	stores := map[string]secrets.Store{}
+	types := []string{storeType()}
+	for _, route := range config.SecretStore.Routes {
+		types = append(types, route.Stores...)
+	}
+	for _, storeType := range types {
+		if _, ok := stores[storeType]; ok {
+			continue
+		}
+		store, err := openStore(ctx, storeType)
+		if err != nil {
+			for _, opened := range stores {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("secret store %s: %v", storeType, err)
+		}
+		stores[storeType] = store
+	}
+	return secrets.NewMulti(stores, routeStores), nil
+}
+
+//openStore connects to a store by type
+func openStore(ctx context.Context, storeType string) (secrets.Store, error) {
+	switch storeType {
+	case "", configuration.StoreGCP:
+		client, err := gcp.NewClient(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case configuration.StoreVault:
+		vault, err := secrets.NewVault(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return vault, nil
+	case configuration.StoreAWS:
+		aws, err := secrets.NewAWS(config)
+		if err != nil {
+			return nil, err
+		}
+		return aws, nil
+	case configuration.StoreAzure:
+		azure, err := secrets.NewAzure(config)
+		if err != nil {
+			return nil, err
+		}
+		return azure, nil
+	case configuration.StoreFile:
+		file, err := secrets.NewFile(config)
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	return nil, fmt.Errorf("unknown secret store type %q", storeType)
+}
+
+//secretName is the full name of the secret of a user in its stores, for the reports and the logs
+func secretName(user configuration.MongoUser) (string, error) {
+	var names []string
+	for _, storeType := range routeStores(user) {
+		name, err := storeSecretName(storeType, user)
+		if err != nil {
+			return "", err
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ";"), nil
+}
+
+//storeSecretName is the full name of the secret of a user in a store
+func storeSecretName(storeType string, user configuration.MongoUser) (string, error) {
+	switch storeType {
+	case "", configuration.StoreGCP:
+		return gcp.SecretName(config, user)
+	case configuration.StoreVault:
+		return secrets.VaultSecretName(config, user)
+	case configuration.StoreAWS:
+		return secrets.AWSSecretName(config, user)
+	case configuration.StoreAzure:
+		return secrets.AzureSecretName(config, user)
+	case configuration.StoreFile:
+		return secrets.FileSecretName(config, user)
+	}
+	return "", fmt.Errorf("unknown secret store type %q", storeType)
+}
+
+//checkSecretNames finds the users which can't be given a secret of their own: the template may not name them, or
+//the template, sanitize and the naming rules of the stores may map distinct usernames to one name, they would
+//overwrite each other's password. The Kubernetes Secrets the users are copied to are checked the same way.
+//The errors are keyed by checkpointKey, the other users can be rotated.
+func checkSecretNames(users []configuration.MongoUser) map[string]error {
+	failures := map[string]error{}
+	owners := map[string]configuration.MongoUser{}
+	for _, user := range users {
+		userKey := checkpointKey(user.ProjectID, user.DBName, user.Username)
+		names, err := userSecretNames(user)
+		if err != nil {
+			failures[userKey] = err
+			continue
+		}
+		for _, name := range names {
+			owner, taken := owners[name]
+			if !taken {
+				owners[name] = user
+				continue
+			}
+			if owner.Username != user.Username || owner.DBName != user.DBName {
+				collision := fmt.Errorf("secret name collision, change gcp.secret_name_template: %s of the DB %s and %s of the DB %s share the %s secret",
+					owner.Username, owner.DBName, user.Username, user.DBName, name)
+				failures[checkpointKey(owner.ProjectID, owner.DBName, owner.Username)] = collision
+				failures[userKey] = collision
+			}
+		}
+	}
+	return failures
+}
+
+//userSecretNames are the secrets a user is saved to, prefixed by their store and compared as the store compares them
+func userSecretNames(user configuration.MongoUser) ([]string, error) {
+	var names []string
+	for _, storeType := range routeStores(user) {
+		name, err := storeSecretName(storeType, user)
+		if err != nil {
+			return nil, err
+		}
+		if storeType == configuration.StoreAzure {
+			//Key Vault names are case insensitive
+			name = strings.ToLower(name)
+		}
+		names = append(names, storeType+" "+name)
+	}
+	if !config.Kubernetes.Enabled {
+		return names, nil
+	}
+	targets, err := kubernetesTargets(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		names = append(names, "kubernetes "+target.Namespace+"/"+target.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	configuration "mongo-util/config"
+	"strings"
+	"testing"
+)
+
+func TestCheckSecretNames(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = configuration.Config{}
+	config.GCP.ProjectID = "gcp-project"
+	config.GCP.SecretNameTemplate = "mongo-{{sanitize .DBName}}-{{.Username}}"
+
+	user := func(username, dbName string) configuration.MongoUser {
+		return configuration.MongoUser{Username: username, DBName: dbName, ProjectID: "5f1a2b3c4d5e6f7a8b9c0d1e"}
+	}
+	users := []configuration.MongoUser{
+		user("app", "admin"),
+		//sanitize turns both databases into orders_eu
+		user("orders", "orders.eu"),
+		user("orders", "orders_eu"),
+		//@ is not allowed in a secret id
+		user("john@corp", "admin"),
+	}
+	failures := checkSecretNames(users)
+	if len(failures) != 3 {
+		t.Fatalf("checkSecretNames returned %v, want the two colliding users and the unnamed one", failures)
+	}
+	if err := failures[checkpointKey(users[0].ProjectID, "admin", "app")]; err != nil {
+		t.Errorf("app fails with %v, it has a secret of its own", err)
+	}
+	for _, dbName := range []string{"orders.eu", "orders_eu"} {
+		err := failures[checkpointKey(users[0].ProjectID, dbName, "orders")]
+		if err == nil || !strings.Contains(err.Error(), "collision") {
+			t.Errorf("orders of the DB %s: got %v, want a collision", dbName, err)
+		}
+	}
+	if err := failures[checkpointKey(users[0].ProjectID, "admin", "john@corp")]; err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Errorf("john@corp: got %v, want an invalid secret id", err)
+	}
+
+	if failures := checkSecretNames(users[:1]); len(failures) != 0 {
+		t.Errorf("a single user fails with %v", failures)
+	}
+}
+
+func TestCheckSecretNamesOfKubernetes(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = configuration.Config{}
+	config.GCP.SecretNameTemplate = "{{.Username}}"
+	config.Kubernetes.Enabled = true
+	config.Kubernetes.Apps = []configuration.KubernetesApp{{Secret: "orders-db", Username: "orders"}, {Secret: "orders-db", Username: "billing"}}
+
+	users := []configuration.MongoUser{
+		//the Secrets are lowercased with _ turned into -, as Kubernetes names must be
+		{Username: "App_1", DBName: "admin"},
+		{Username: "app-1", DBName: "admin"},
+		//two apps write the same Secret
+		{Username: "orders", DBName: "admin"},
+		{Username: "billing", DBName: "admin"},
+		{Username: "reports", DBName: "admin"},
+	}
+	failures := checkSecretNames(users)
+	for _, user := range users[:4] {
+		err := failures[checkpointKey(user.ProjectID, user.DBName, user.Username)]
+		if err == nil || !strings.Contains(err.Error(), "kubernetes") {
+			t.Errorf("%s: got %v, want a collision of its Kubernetes Secret", user.Username, err)
+		}
+	}
+	if err := failures[checkpointKey("", "admin", "reports")]; err != nil {
+		t.Errorf("reports fails with %v, it has a Secret of its own", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	mongo "mongo-util/mongo"
+	"strings"
+	"time"
+)
+
+const (
+	//DefaultCredentialsTTL is the lifetime of the temporary users when -ttl is not set
+	DefaultCredentialsTTL = "1h"
+	//maxCredentialsTTL is the furthest deleteAfterDate Atlas accepts
+	maxCredentialsTTL = 7 * 24 * time.Hour
+	//temporaryUserPrefix names the temporary users when -username is not set
+	temporaryUserPrefix = "tmp-"
+)
+
+//credentialsRequest holds the issue_credentials arguments
+type credentialsRequest struct {
+	Username string
+	Roles    string
+	Clusters string
+	TTL      string
+}
+
+//parseRoles reads roles given as roleName@databaseName, comma separated
+func parseRoles(roles string) ([]configuration.UserRole, error) {
+	var parsed []configuration.UserRole
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role == "" {
+			continue
+		}
+		parts := strings.SplitN(role, "@", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid role %q, expected roleName@databaseName eg: read@orders", role)
+		}
+		parsed = append(parsed, configuration.UserRole{RoleName: parts[0], DatabaseName: parts[1]})
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("%s argument is required eg: -%s=read@orders", Roles, Roles)
+	}
+	return parsed, nil
+}
+
+//parseScopes limits a user to the given clusters, comma separated
+func parseScopes(clusters string) []configuration.UserScope {
+	var scopes []configuration.UserScope
+	for _, cluster := range strings.Split(clusters, ",") {
+		if cluster = strings.TrimSpace(cluster); cluster != "" {
+			scopes = append(scopes, configuration.UserScope{Name: cluster, Type: "CLUSTER"})
+		}
+	}
+	return scopes
+}
+
+//resolveProject sets the id of the project named projectName in config.Mongo
+func resolveProject(projectName *string) error {
+	if projectName == nil || *projectName == "" {
+		return fmt.Errorf("%s argument is missing the value", ProjectName)
+	}
+	config.Mongo.ProjectName = *projectName
+	project, err := mongo.GetProjectByProjectName(config.Mongo)
+	if err != nil {
+		return err
+	}
+	config.Mongo.ProjectID = project.ID
+	return nil
+}
+
+//issueCredentials creates a temporary db user which Atlas deletes after the TTL,
+//its password is saved to secret manager and the secret path is printed
+func issueCredentials(projectName *string, request credentialsRequest) error {
+	roles, err := parseRoles(request.Roles)
+	if err != nil {
+		return err
+	}
+	if request.TTL == "" {
+		request.TTL = DefaultCredentialsTTL
+	}
+	ttl, err := configuration.ParseAge(request.TTL)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", TTL, err)
+	}
+	if ttl <= 0 || ttl > maxCredentialsTTL {
+		return fmt.Errorf("invalid %s %q, it must be positive and at most 7 days", TTL, request.TTL)
+	}
+	if err := validSecretFormat(); err != nil {
+		return err
+	}
+	if err := resolveProject(projectName); err != nil {
+		return err
+	}
+
+	username := request.Username
+	if username == "" {
+		suffix, err := configuration.PasswordPolicy{Length: 8, Alphabet: "abcdefghijklmnopqrstuvwxyz0123456789"}.Generate()
+		if err != nil {
+			return err
+		}
+		username = temporaryUserPrefix + suffix
+	}
+	user := configuration.MongoUser{
+		Username:        username,
+		DBName:          "admin",
+		ProjectID:       config.Mongo.ProjectID,
+		ProjectName:     config.Mongo.ProjectName,
+		Roles:           roles,
+		Scopes:          parseScopes(request.Clusters),
+		DeleteAfterDate: time.Now().Add(ttl).UTC().Format(time.RFC3339),
+		Labels:          []configuration.UserLabel{configuration.TemporaryLabel},
+	}
+
+	pwd, err := config.PasswordPolicy.Generate()
+	if err == nil {
+		err = config.PasswordPolicy.Check(pwd)
+	}
+	if err != nil {
+		return err
+	}
+
+	var clusters []configuration.Cluster
+	if jsonSecrets() {
+		if clusters, err = projectClusters(); err != nil {
+			return err
+		}
+	}
+	secret, err := secretPayload(user, pwd, "", clusters)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	store, err := openSecretStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	//the secret is saved first so that the password is never lost, it is destroyed if Atlas refuses the user
+	version, err := store.SaveSecret(ctx, user, secret)
+	if err != nil {
+		return err
+	}
+	if err := mongo.CreateUser(user, pwd, config.Mongo); err != nil {
+		if dErr := store.DestroyVersion(ctx, version); dErr != nil {
+			log.Printf("unable to destroy the secret version %s: %v", version, dErr)
+		}
+		return fmt.Errorf("create user %s: %v", user.Username, err)
+	}
+
+	log.Printf("temporary user %s created, Atlas deletes it after %s", user.Username, user.DeleteAfterDate)
+	fmt.Println(version)
+	return nil
+}
+
+//listCredentials logs the temporary users of a project with their expiry
+func listCredentials(projectName *string) error {
+	if err := resolveProject(projectName); err != nil {
+		return err
+	}
+	users, err := mongo.GetUsersByProject(config.Mongo)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, user := range users {
+		if !user.IsTemporary() {
+			continue
+		}
+		var roles []string
+		for _, role := range user.Roles {
+			roles = append(roles, role.String())
+		}
+		name, err := secretName(user)
+		if err != nil {
+			name = err.Error()
+		}
+		log.Printf("%s roles %s expires %s secret %s", user.Username, strings.Join(roles, ","), user.DeleteAfterDate, name)
+		count++
+	}
+	log.Printf("%d temporary users under %s", count, config.Mongo.ProjectName)
+	return nil
+}
+
+//revokeCredentials deletes a temporary user before its expiry, and its secret
+func revokeCredentials(projectName *string, username string) error {
+	if username == "" {
+		return fmt.Errorf("%s argument is required", Username)
+	}
+	if err := resolveProject(projectName); err != nil {
+		return err
+	}
+	users, err := mongo.GetUsersByProject(config.Mongo)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Username != username {
+			continue
+		}
+		//only the users issued by issue_credentials can be revoked, the others are managed elsewhere
+		if !user.IsTemporary() {
+			return fmt.Errorf("user %s is not a temporary user", username)
+		}
+		if err := mongo.DeleteUser(user, config.Mongo); err != nil {
+			return fmt.Errorf("delete user %s: %v", username, err)
+		}
+		ctx := context.Background()
+		store, err := openSecretStore(ctx)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		if err := store.DeleteSecret(ctx, user); err != nil {
+			return err
+		}
+		log.Printf("temporary user %s revoked", username)
+		return nil
+	}
+	return errors.New("no such user " + username)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	configuration "mongo-util/config"
+	mongo "mongo-util/mongo"
+	"time"
+)
+
+//Verification statuses of the rotation report
+const (
+	Verified           = "verified"
+	VerifiedNoCluster  = "no cluster"
+	VerificationFailed = "failed"
+)
+
+const (
+	//DefaultVerifyAttempts and DefaultVerifyInterval leave about a minute to Atlas to propagate a new password
+	DefaultVerifyAttempts = 6
+	DefaultVerifyInterval = 10 * time.Second
+)
+
+//projectClusters fetches the clusters of the project, the new passwords are verified against them
+//and their connection strings go into the json secrets
+func projectClusters() ([]configuration.Cluster, error) {
+	clusterInfo, err := mongo.GetClusterInfo(config.Mongo)
+	if err != nil {
+		return nil, fmt.Errorf("get clusters of the project: %v", err)
+	}
+	//a non nil slice keeps the verification enabled for projects without clusters
+	clusters := []configuration.Cluster{}
+	if clusterInfo != nil {
+		clusters = append(clusters, clusterInfo.Clusters...)
+	}
+	return clusters, nil
+}
+
+//inScope tells if a user can access a cluster: it is one of the clusters of its scopes, or the user isn't scoped
+func inScope(user configuration.MongoUser, cluster configuration.Cluster) bool {
+	if len(user.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range user.Scopes {
+		if scope.Type == "CLUSTER" && scope.Name == cluster.Name {
+			return true
+		}
+	}
+	return false
+}
+
+//userClusters are the clusters a user can authenticate to: the clusters of its scopes,
+//or all the clusters of the project if it isn't scoped. Paused clusters can't be reached and are left out.
+func userClusters(user configuration.MongoUser, clusters []configuration.Cluster) []configuration.Cluster {
+	var accessible []configuration.Cluster
+	for _, cluster := range clusters {
+		if !inScope(user, cluster) {
+			continue
+		}
+		if cluster.Paused || cluster.ConnectionStrings.StandardSrv == "" {
+			log.Printf("cluster %s is paused or has no SRV connection string, it is not used for verification", cluster.Name)
+			continue
+		}
+		accessible = append(accessible, cluster)
+	}
+	return accessible
+}
+
+//verifyPassword authenticates with the new password on every cluster of the user and returns the verification status,
+//an empty status means verification is disabled
+func (r *rotator) verifyPassword(user configuration.MongoUser, pwd string) (string, error) {
+	if r.clusters == nil {
+		return "", nil
+	}
+	clusters := userClusters(user, r.clusters)
+	if len(clusters) == 0 {
+		log.Printf("WARNING: new password of %s for the DB %s is not verified, no reachable cluster", user.Username, user.DBName)
+		return VerifiedNoCluster, nil
+	}
+
+	attempts, interval := r.verify.Attempts, time.Duration(r.verify.Interval)*time.Second
+	if attempts <= 0 {
+		attempts = DefaultVerifyAttempts
+	}
+	if interval <= 0 {
+		interval = DefaultVerifyInterval
+	}
+	for _, cluster := range clusters {
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			//Atlas takes a while to apply a new password on every cluster member
+			if err = mongo.VerifyCredentials(cluster.ConnectionStrings.StandardSrv, user.Username, pwd, user.DBName); err == nil {
+				break
+			}
+			if attempt < attempts {
+				log.Printf("verification of %s on cluster %s failed (attempt %d/%d), retrying in %s: %v",
+					user.Username, cluster.Name, attempt, attempts, interval, err)
+				time.Sleep(interval)
+			}
+		}
+		if err != nil {
+			return VerificationFailed, fmt.Errorf("cluster %s: %v", cluster.Name, err)
+		}
+		log.Printf("new password of %s verified on cluster %s", user.Username, cluster.Name)
+	}
+	return Verified, nil
+}